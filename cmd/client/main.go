@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
@@ -10,9 +15,21 @@ import (
 	"github.com/rabbitmq/amqp091-go"
 )
 
+const (
+	shutdownTimeout = 10 * time.Second
+	rpcTimeout      = 5 * time.Second
+)
+
 func main() {
 	fmt.Println("Starting Peril client...")
 
+	// The server rejects every command that doesn't prove who we are
+	token := os.Getenv("PERIL_TOKEN")
+	if token == "" {
+		fmt.Println("PERIL_TOKEN must be set to the token for your username; the server's operator can print one with `server token <username>`.")
+		os.Exit(1)
+	}
+
 	connection, channel, err := pubsub.ConnectToRabbitMQ()
 	if err != nil {
 		fmt.Printf("Error connecting to RabbitMQ: %v", err)
@@ -26,92 +43,194 @@ func main() {
 		return
 	}
 
-	_, _, err = pubsub.DeclareAndBind(
+	// The server turns us away unless we play by the same rules
+	rules, err := gamelogic.LoadActiveRules()
+	if err != nil {
+		fmt.Printf("Error loading rules: %v", err)
+		return
+	}
+	fmt.Printf("Using ruleset %s\n", rules.ShortHash())
+
+	creds := credentials{rules: rules, token: token}
+	err = pubsub.SubscribeJSON(
 		connection,
 		routing.ExchangePerilDirect,
-		routing.PauseKey+"."+username,
-		routing.PauseKey,
+		routing.RulesKey+"."+username,
+		routing.RulesKey,
 		pubsub.Transient,
+		handlerRules(rules),
 	)
 	if err != nil {
-		fmt.Printf("Error declaring/binding to queue: %v", err)
+		fmt.Printf("Error subscribing to rules channel: %v", err)
 		return
 	}
 
 	gamestate := gamelogic.NewGameState(username)
+	rpc, err := pubsub.NewRPCClient(connection, "")
+	if err != nil {
+		fmt.Printf("Error creating rpc client: %v", err)
+		return
+	}
+	defer rpc.Close()
 
-	// Bind to channels
+	// The server owns our units; the view follows the changes it publishes
 	err = pubsub.SubscribeJSON(
 		connection,
-		routing.ExchangePerilDirect,
-		"pause."+username,
-		routing.PauseKey,
+		routing.ExchangePerilTopic,
+		routing.StateDeltaPrefix+"."+username,
+		routing.StateDeltaPrefix+"."+username,
 		pubsub.Transient,
-		handlerPause(gamestate),
+		handlerState(rpc, gamestate, creds),
 	)
 	if err != nil {
-		fmt.Printf("Error subscribing to pause channel: %v", err)
+		fmt.Printf("Error subscribing to state channel: %v", err)
 		return
 	}
 
-	ch, _ := connection.Channel()
-	err = pubsub.SubscribeJSON(
+	// Ask the server whether we're joining a paused game, and for the units
+	// we left behind last time
+	if err := syncPlayingState(rpc, gamestate); err != nil {
+		fmt.Printf("Could not fetch playing state from server: %v\n", err)
+	}
+	if err := gamestate.SyncPlayer(fetchPlayer(rpc, gamestate, creds)); err != nil {
+		fmt.Printf("Could not fetch your units from server: %v\n", err)
+	} else if units := len(gamestate.GetPlayerSnap().Units); units > 0 {
+		fmt.Printf("Restored %d unit(s) from your last session\n", units)
+	}
+
+	// Bind to channels. Pauses and moves share a queue so a pause is
+	// handled before any moves still waiting; moves expire on their own
+	err = pubsub.SubscribeRoutes(
 		connection,
-		routing.ExchangePerilTopic,
-		string(routing.ArmyMovesPrefix)+"."+username,
-		string(routing.ArmyMovesPrefix)+".*",
+		routing.PlayQueuePrefix+"."+username,
 		pubsub.Transient,
-		handlerMove(gamestate, ch),
+		[]pubsub.Route{
+			pubsub.RouteJSON(routing.ExchangePerilDirect, routing.PauseKey, handlerPause(gamestate)),
+			pubsub.RouteJSON(routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".*", handlerMove(gamestate)),
+		},
+		pubsub.WithMaxPriority(routing.MaxPriority),
 	)
 	if err != nil {
-		fmt.Printf("Error subscribing to move channel: %v", err)
+		fmt.Printf("Error subscribing to play channel: %v", err)
 		return
 	}
 
+	// Every war: a battle can have any number of sides, so there's no
+	// per-player key, and the ones we aren't in are reported and dropped
 	err = pubsub.SubscribeJSON(
 		connection,
 		routing.ExchangePerilTopic,
-		string(routing.WarRecognitionsPrefix),
-		string(routing.WarRecognitionsPrefix)+".*",
-		pubsub.Durable,
-		handlerWar(gamestate, ch),
+		routing.WarRecognitionsPrefix+"."+username,
+		routing.WarRecognitionsPrefix+".#",
+		pubsub.Quorum,
+		handlerWar(gamestate, rules),
+		pubsub.WithDeliveryLimit(routing.WarDeliveryLimit),
+		pubsub.WithExpires(routing.WarQueueExpiry),
+		pubsub.WithMaxLength(routing.WarQueueMaxLength),
+		pubsub.WithOverflow(pubsub.OverflowDropHead),
 	)
 	if err != nil {
 		fmt.Printf("Error subscribing to war channel: %v", err)
 		return
 	}
 
+	// Keep "spam" from flooding game_logs faster than the server will accept
+	logLimiter := pubsub.NewRateLimiter(routing.GameLogPublishRate, routing.GameLogPublishBurst)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
 	// REPL
+	inputs, next := gamelogic.ReadInputs()
+repl:
 	for {
-		words := gamelogic.GetInput()
+		next()
+		var words []string
+		select {
+		case sig := <-signals:
+			fmt.Printf("\nReceived %v\n", sig)
+			break repl
+		case input, ok := <-inputs:
+			if !ok {
+				gamelogic.PrintQuit()
+				break repl
+			}
+			words = input
+		}
 		if len(words) == 0 {
 			continue
 		}
 		command := words[0]
 
 		if command == "spawn" {
-			if err := gamestate.CommandSpawn(words); err != nil {
+			cmd, err := gamelogic.ParseSpawn(username, words)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			cmd.RulesHash = rules.Hash()
+			cmd.Token = token
+			delta, err := sendCommand(rpc, gamestate, creds, routing.SpawnRPCKey, cmd)
+			if err != nil {
 				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			for _, unit := range delta.Units {
+				fmt.Printf("Spawned a(n) %s in %s with id %v\n", unit.Rank, unit.Location, unit.ID)
 			}
 		} else if command == "move" {
-			move, err := gamestate.CommandMove(words)
+			cmd, err := gamelogic.ParseMove(username, words)
 			if err != nil {
 				fmt.Printf("error: %v\n", err)
-			} else {
-				fmt.Printf("Move to %s succeeded!\n", move.ToLocation)
+				continue
 			}
-
-			// publish move
-			err = pubsub.PublishJSON(
-				channel,
-				string(routing.ExchangePerilTopic),
-				string(routing.ArmyMovesPrefix)+"."+username,
-				move)
+			cmd.RulesHash = rules.Hash()
+			cmd.Token = token
+			if _, err := sendCommand(rpc, gamestate, creds, routing.MoveRPCKey, cmd); err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Move to %s succeeded!\n", cmd.ToLocation)
+		} else if command == "retreat" {
+			cmd, err := gamelogic.ParseRetreat(username, words)
 			if err != nil {
 				fmt.Printf("error: %v\n", err)
-			} else {
-				fmt.Println("successfully published move!")
+				continue
+			}
+			cmd.RulesHash = rules.Hash()
+			cmd.Token = token
+			if _, err := sendCommand(rpc, gamestate, creds, routing.RetreatRPCKey, cmd); err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Retreated from %s to %s!\n", cmd.From, cmd.To)
+		} else if command == "reinforce" {
+			cmd, err := gamelogic.ParseReinforce(username, words)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			cmd.RulesHash = rules.Hash()
+			cmd.Token = token
+			if _, err := sendCommand(rpc, gamestate, creds, routing.ReinforceRPCKey, cmd); err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Reinforced the battle in %s!\n", cmd.Location)
+		} else if command == "fortify" {
+			cmd, err := gamelogic.ParseFortify(username, words)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			cmd.RulesHash = rules.Hash()
+			cmd.Token = token
+			delta, err := sendCommand(rpc, gamestate, creds, routing.FortifyRPCKey, cmd)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
 			}
+			fmt.Printf("Fortified %d unit(s) in %s\n", len(delta.Units), cmd.Location)
 		} else if command == "status" {
 			gamestate.CommandStatus()
 		} else if command == "help" {
@@ -119,6 +238,7 @@ func main() {
 		} else if command == "spam" {
 			if len(words) < 2 {
 				fmt.Println("spam command expected an arg (count)")
+				continue
 			}
 
 			count, err := strconv.Atoi(words[1])
@@ -128,91 +248,148 @@ func main() {
 			}
 
 			for range count {
+				select {
+				case sig := <-signals:
+					fmt.Printf("\nReceived %v\n", sig)
+					break repl
+				default:
+				}
+				logLimiter.Wait()
 				maliciousLog := gamelogic.GetMaliciousLog()
 				pubsub.PublishGameLog(channel, username, maliciousLog)
 			}
 		} else if command == "quit" {
 			gamelogic.PrintQuit()
-			break
+			break repl
 		} else {
 			fmt.Println("Please type a valid command.")
 		}
 	}
 
 	fmt.Println("Shutting down Peril client...")
+	os.Exit(shutdown(connection, rpc))
 }
 
-func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
-	return func(ps routing.PlayingState) pubsub.AckType {
-		defer fmt.Print("> ")
-		gs.HandlePause(ps)
-		return pubsub.Ack
+// shutdown lets in-flight handlers finish before closing the connection,
+// and returns the process exit status.
+func shutdown(connection *amqp091.Connection, rpc *pubsub.RPCClient) int {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	status := 0
+	if err := pubsub.Shutdown(ctx); err != nil {
+		fmt.Printf("error draining consumers: %v\n", err)
+		status = 1
 	}
+	rpc.Close()
+	if err := connection.Close(); err != nil {
+		fmt.Printf("error closing connection: %v\n", err)
+		status = 1
+	}
+	return status
 }
 
-func handlerMove(gs *gamelogic.GameState, ch *amqp091.Channel) func(gamelogic.ArmyMove) pubsub.AckType {
-	return func(move gamelogic.ArmyMove) pubsub.AckType {
-		defer fmt.Print("> ")
-		outcome := gs.HandleMove(move)
+// sendCommand asks the server to carry out cmd and applies the resulting
+// delta right away rather than waiting for it on the state queue.
+func sendCommand[Cmd any](rpc *pubsub.RPCClient, gs *gamelogic.GameState, creds credentials, key string, cmd Cmd) (gamelogic.StateDelta, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
 
-		switch outcome {
-		case gamelogic.MoveOutcomeSamePlayer:
-			return pubsub.NackDiscard
+	delta, err := pubsub.CallJSON[Cmd, gamelogic.StateDelta](ctx, rpc, routing.ExchangePerilDirect, key, cmd)
+	if err != nil {
+		return delta, err
+	}
+	if err := gs.ApplyDeltaOrSync(delta, fetchPlayer(rpc, gs, creds)); err != nil {
+		fmt.Printf("Could not catch up with the server: %v\n", err)
+	}
+	return delta, nil
+}
 
-		case gamelogic.MoveOutComeSafe:
-			return pubsub.Ack
+// credentials are what the server checks a player's requests against.
+type credentials struct {
+	rules *gamelogic.Rules
+	token string
+}
 
-		case gamelogic.MoveOutcomeMakeWar:
-			key := fmt.Sprintf("%s.%s", routing.WarRecognitionsPrefix, gs.Player.Username)
-			rec := gamelogic.RecognitionOfWar{
-				Attacker: move.Player,
-				Defender: gs.GetPlayerSnap(),
-			}
-			err := pubsub.PublishJSON(
-				ch,
-				string(routing.ExchangePerilTopic),
-				key,
-				rec,
-			)
-			if err != nil {
-				fmt.Printf("Error publishing war message: %v\n", err)
-				return pubsub.NackRequeue
-			}
-			return pubsub.Ack
+// fetchPlayer asks the server for the units it has on record for the
+// player.
+func fetchPlayer(rpc *pubsub.RPCClient, gs *gamelogic.GameState, creds credentials) func() (gamelogic.Player, error) {
+	return func() (gamelogic.Player, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+		defer cancel()
 
-		default:
-			return pubsub.NackDiscard
-		}
+		return pubsub.CallJSON[routing.PlayerStateRequest, gamelogic.Player](
+			ctx,
+			rpc,
+			routing.ExchangePerilDirect,
+			routing.PlayerStateRPCKey,
+			routing.PlayerStateRequest{Username: gs.GetUsername(), RulesHash: creds.rules.Hash(), Token: creds.token},
+		)
 	}
 }
 
-func handlerWar(gs *gamelogic.GameState, ch *amqp091.Channel) func(gamelogic.RecognitionOfWar) pubsub.AckType {
-	return func(rec gamelogic.RecognitionOfWar) pubsub.AckType {
-		defer fmt.Print("> ")
-		outcome, winner, loser := gs.HandleWar(rec)
-
-		switch outcome {
-		case gamelogic.WarOutcomeNotInvolved:
-			return pubsub.NackRequeue
+func syncPlayingState(rpc *pubsub.RPCClient, gs *gamelogic.GameState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
 
-		case gamelogic.WarOutcomeNoUnits:
-			return pubsub.NackDiscard
+	ps, err := pubsub.CallJSON[routing.PlayingStateRequest, routing.PlayingState](
+		ctx,
+		rpc,
+		routing.ExchangePerilDirect,
+		routing.PlayingStateRPCKey,
+		routing.PlayingStateRequest{Username: gs.GetUsername()},
+	)
+	if err != nil {
+		return err
+	}
+	gs.HandlePause(ps)
+	return nil
+}
 
-		case gamelogic.WarOutcomeOpponentWon:
-			msg := fmt.Sprintf("%s won a war against %s", winner, loser)
-			return pubsub.PublishGameLog(ch, gs.GetUsername(), msg)
+func handlerState(rpc *pubsub.RPCClient, gs *gamelogic.GameState, creds credentials) func(gamelogic.StateDelta) pubsub.AckType {
+	return func(delta gamelogic.StateDelta) pubsub.AckType {
+		if err := gs.ApplyDeltaOrSync(delta, fetchPlayer(rpc, gs, creds)); err != nil {
+			fmt.Printf("Could not catch up with the server: %v\n", err)
+		}
+		return pubsub.Ack
+	}
+}
 
-		case gamelogic.WarOutcomeYouWon:
-			msg := fmt.Sprintf("%s won a war against %s", winner, loser)
-			return pubsub.PublishGameLog(ch, gs.GetUsername(), msg)
+func handlerRules(rules *gamelogic.Rules) func(routing.RulesetInfo) pubsub.AckType {
+	return func(info routing.RulesetInfo) pubsub.AckType {
+		defer fmt.Print("> ")
+		if err := rules.CheckHash(info.Hash); err != nil {
+			fmt.Printf("\nThe server changed rules (version %d); restart with its ruleset to keep playing.\n", info.Version)
+		}
+		return pubsub.Ack
+	}
+}
 
-		case gamelogic.WarOutcomeDraw:
-			msg := fmt.Sprintf("A war between %s and %s resulted in a draw", winner, loser)
-			return pubsub.PublishGameLog(ch, gs.GetUsername(), msg)
+func handlerPause(gs *gamelogic.GameState) func(routing.PlayingState) pubsub.AckType {
+	return func(ps routing.PlayingState) pubsub.AckType {
+		defer fmt.Print("> ")
+		gs.HandlePause(ps)
+		return pubsub.Ack
+	}
+}
 
-		default:
-			fmt.Println("error: unrecognized war outcome")
+func handlerMove(gs *gamelogic.GameState) func(gamelogic.ArmyMove) pubsub.AckType {
+	return func(move gamelogic.ArmyMove) pubsub.AckType {
+		defer fmt.Print("> ")
+		if gs.HandleMove(move) == gamelogic.MoveOutcomeSamePlayer {
 			return pubsub.NackDiscard
 		}
+		return pubsub.Ack
+	}
+}
+
+func handlerWar(gs *gamelogic.GameState, rules *gamelogic.Rules) func(gamelogic.WarResolved) pubsub.AckType {
+	return func(war gamelogic.WarResolved) pubsub.AckType {
+		defer fmt.Print("> ")
+		if err := rules.CheckWar(war); err != nil {
+			fmt.Printf("warning: %v\n", err)
+		}
+		gs.ApplyWar(war)
+		return pubsub.Ack
 	}
 }
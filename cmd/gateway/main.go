@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/auth"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/gorilla/websocket"
+)
+
+const defaultAddr = ":8080"
+
+// Players authenticate with a token derived from their username and the
+// secret shared with the servers; "gateway token <username>" prints one.
+func main() {
+	secret, err := auth.Secret()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) == 3 && os.Args[1] == "token" {
+		fmt.Println(auth.Token(secret, os.Args[2]))
+		return
+	}
+
+	addr := os.Getenv("PERIL_GATEWAY_ADDR")
+	if addr == "" {
+		addr = defaultAddr
+	}
+
+	fmt.Println("Starting Peril gateway...")
+	rules, err := gamelogic.LoadActiveRules()
+	if err != nil {
+		fmt.Printf("Error loading rules: %v", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Using ruleset %s\n", rules.ShortHash())
+	origins := allowedOrigins()
+	if len(origins) > 0 {
+		fmt.Printf("Allowing web players from %s\n", strings.Join(origins, ", "))
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     checkOrigin(origins),
+	}
+	http.HandleFunc("/ws", handlerWebsocket(secret, &upgrader, rules))
+
+	fmt.Printf("Listening on %s\n", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		fmt.Printf("Error serving gateway: %v", err)
+		os.Exit(1)
+	}
+}
+
+// allowedOrigins reads the comma-separated origins web players may connect
+// from, e.g. "https://peril.example.com,http://localhost:3000".
+func allowedOrigins() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(os.Getenv("PERIL_GATEWAY_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return origins
+}
+
+// checkOrigin lets browsers connect from the gateway's own host or one of
+// allowed. Clients that send no Origin aren't browsers and are let through.
+func checkOrigin(allowed []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range allowed {
+			if strings.EqualFold(origin, o) {
+				return true
+			}
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+}
+
+// authenticate accepts the token as a bearer header or, since browsers can't
+// set headers on websocket requests, as a query parameter.
+// The token is passed on with the player's commands for the server to check.
+func authenticate(secret string, r *http.Request) (username, token string, ok bool) {
+	username = r.URL.Query().Get("username")
+	if username == "" || strings.ContainsAny(username, ".*#") {
+		return "", "", false
+	}
+
+	token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return username, token, auth.Check(secret, username, token) == nil
+}
+
+func handlerWebsocket(secret string, upgrader *websocket.Upgrader, rules *gamelogic.Rules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, token, ok := authenticate(secret, r)
+		if !ok {
+			http.Error(w, "invalid username or token", http.StatusUnauthorized)
+			return
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			fmt.Printf("error upgrading %s's connection: %v\n", username, err)
+			return
+		}
+
+		s, err := newSession(username, token, ws, rules)
+		if err != nil {
+			fmt.Printf("error starting session for %s: %v\n", username, err)
+			ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "could not reach the game server"))
+			ws.Close()
+			return
+		}
+		fmt.Printf("%s connected\n", username)
+		s.run()
+		fmt.Printf("%s disconnected\n", username)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/gorilla/websocket"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+const rpcTimeout = 5 * time.Second
+
+// frame is the JSON envelope for everything sent over the websocket.
+type frame struct {
+	Type  string          `json:"type"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type moveCommand struct {
+	Location string `json:"location"`
+	UnitIDs  []int  `json:"unitIDs"`
+}
+
+type spawnCommand struct {
+	Location string `json:"location"`
+	Rank     string `json:"rank"`
+}
+
+// session plays on behalf of one websocket. It gets its own broker
+// connection so closing it tears down the player's transient queues.
+type session struct {
+	username   string
+	token      string
+	ws         *websocket.Conn
+	connection *amqp091.Connection
+	rpc        *pubsub.RPCClient
+	rules      *gamelogic.Rules
+	gamestate  *gamelogic.GameState
+	out        chan frame
+	done       chan struct{}
+}
+
+// newSession subscribes the player's queues. The same player may be
+// connected more than once, so every queue name ends in an ID of its own.
+func newSession(username, token string, ws *websocket.Conn, rules *gamelogic.Rules) (s *session, err error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	connection, _, err := pubsub.ConnectToRabbitMQ()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			connection.Close()
+		}
+	}()
+
+	rpc, err := pubsub.NewRPCClient(connection, "")
+	if err != nil {
+		return nil, err
+	}
+
+	s = &session{
+		username:   username,
+		token:      token,
+		ws:         ws,
+		connection: connection,
+		rpc:        rpc,
+		rules:      rules,
+		gamestate:  gamelogic.NewGameState(username),
+		out:        make(chan frame, 64),
+		done:       make(chan struct{}),
+	}
+
+	err = pubsub.SubscribeJSON(
+		connection,
+		routing.ExchangePerilTopic,
+		"gateway."+routing.StateDeltaPrefix+"."+username+"."+id,
+		routing.StateDeltaPrefix+"."+username,
+		pubsub.Transient,
+		s.handlerState(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Pauses jump ahead of the moves still waiting to be forwarded
+	err = pubsub.SubscribeRoutes(
+		connection,
+		"gateway."+routing.PlayQueuePrefix+"."+username+"."+id,
+		pubsub.Transient,
+		[]pubsub.Route{
+			pubsub.RouteJSON(routing.ExchangePerilDirect, routing.PauseKey, s.handlerPause()),
+			pubsub.RouteJSON(routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".*", forward[gamelogic.ArmyMove](s, "move")),
+		},
+		pubsub.WithMaxPriority(routing.MaxPriority),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every war, so the player can watch the ones they aren't in too
+	err = pubsub.SubscribeJSON(
+		connection,
+		routing.ExchangePerilTopic,
+		"gateway."+routing.WarRecognitionsPrefix+"."+username+"."+id,
+		routing.WarRecognitionsPrefix+".#",
+		pubsub.Transient,
+		forward[gamelogic.WarResolved](s, "war"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start from the units the server has on record for the player
+	if err := s.gamestate.SyncPlayer(s.fetchPlayer); err != nil {
+		fmt.Printf("could not fetch %s's units: %v\n", username, err)
+	}
+
+	return s, nil
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating session id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *session) run() {
+	defer s.connection.Close()
+	defer close(s.done)
+	go s.writeLoop()
+
+	for {
+		var f frame
+		if err := s.ws.ReadJSON(&f); err != nil {
+			return
+		}
+
+		data, err := s.handleCommand(f)
+		if err != nil {
+			s.send(frame{Type: "error", Error: err.Error()})
+			continue
+		}
+		s.send(frame{Type: f.Type + "_ok", Data: data})
+	}
+}
+
+func (s *session) writeLoop() {
+	defer s.ws.Close()
+	for {
+		select {
+		case f := <-s.out:
+			if err := s.ws.WriteJSON(f); err != nil {
+				fmt.Printf("error writing to %s: %v\n", s.username, err)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// send drops frames for a client that has fallen too far behind rather than
+// stalling the broker consumers.
+func (s *session) send(f frame) {
+	select {
+	case s.out <- f:
+	case <-s.done:
+	default:
+		fmt.Printf("dropping %s frame for slow client %s\n", f.Type, s.username)
+	}
+}
+
+// handleCommand passes commands on to the server, which validates them
+// against the player's canonical state.
+func (s *session) handleCommand(f frame) (json.RawMessage, error) {
+	var delta gamelogic.StateDelta
+	switch f.Type {
+	case "spawn":
+		var cmd spawnCommand
+		if err := json.Unmarshal(f.Data, &cmd); err != nil {
+			return nil, fmt.Errorf("invalid spawn command: %v", err)
+		}
+		spawn, err := gamelogic.ParseSpawn(s.username, []string{"spawn", cmd.Location, cmd.Rank})
+		if err != nil {
+			return nil, err
+		}
+		spawn.RulesHash = s.rules.Hash()
+		spawn.Token = s.token
+		delta, err = call(s, routing.SpawnRPCKey, spawn)
+		if err != nil {
+			return nil, err
+		}
+
+	case "move":
+		var cmd moveCommand
+		if err := json.Unmarshal(f.Data, &cmd); err != nil {
+			return nil, fmt.Errorf("invalid move command: %v", err)
+		}
+		words := []string{"move", cmd.Location}
+		for _, id := range cmd.UnitIDs {
+			words = append(words, strconv.Itoa(id))
+		}
+		move, err := gamelogic.ParseMove(s.username, words)
+		if err != nil {
+			return nil, err
+		}
+		move.RulesHash = s.rules.Hash()
+		move.Token = s.token
+		delta, err = call(s, routing.MoveRPCKey, move)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown command %q", f.Type)
+	}
+
+	s.applyDelta(delta)
+	return json.Marshal(s.gamestate.GetPlayerSnap())
+}
+
+// fetchPlayer asks the server for the units it has on record for the
+// player.
+func (s *session) fetchPlayer() (gamelogic.Player, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	return pubsub.CallJSON[routing.PlayerStateRequest, gamelogic.Player](
+		ctx,
+		s.rpc,
+		routing.ExchangePerilDirect,
+		routing.PlayerStateRPCKey,
+		routing.PlayerStateRequest{Username: s.username, RulesHash: s.rules.Hash(), Token: s.token},
+	)
+}
+
+func (s *session) applyDelta(delta gamelogic.StateDelta) {
+	if err := s.gamestate.ApplyDeltaOrSync(delta, s.fetchPlayer); err != nil {
+		fmt.Printf("could not catch %s up with the server: %v\n", s.username, err)
+	}
+}
+
+func call[Cmd any](s *session, key string, cmd Cmd) (gamelogic.StateDelta, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rpcTimeout)
+	defer cancel()
+	return pubsub.CallJSON[Cmd, gamelogic.StateDelta](ctx, s.rpc, routing.ExchangePerilDirect, key, cmd)
+}
+
+func (s *session) handlerState() func(gamelogic.StateDelta) pubsub.AckType {
+	push := forward[gamelogic.StateDelta](s, "state")
+	return func(delta gamelogic.StateDelta) pubsub.AckType {
+		s.applyDelta(delta)
+		return push(delta)
+	}
+}
+
+func (s *session) handlerPause() func(routing.PlayingState) pubsub.AckType {
+	push := forward[routing.PlayingState](s, "pause")
+	return func(ps routing.PlayingState) pubsub.AckType {
+		if !s.gamestate.HandlePause(ps) {
+			return pubsub.Ack
+		}
+		return push(ps)
+	}
+}
+
+func forward[T any](s *session, frameType string) func(T) pubsub.AckType {
+	return func(val T) pubsub.AckType {
+		data, err := json.Marshal(val)
+		if err != nil {
+			fmt.Printf("error encoding %s frame: %v\n", frameType, err)
+			return pubsub.NackDiscard
+		}
+		s.send(frame{Type: frameType, Data: data})
+		return pubsub.Ack
+	}
+}
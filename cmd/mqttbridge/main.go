@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/mqtt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// bridgedPrefix describes how messages under a routing key prefix are
+// encoded, so content types can be restored on the way back into RabbitMQ.
+type bridgedPrefix struct {
+	prefix      string
+	contentType string
+	opts        []pubsub.PublishOption
+	// Only the server may publish these, so MQTT clients can't send them
+	serverOnly bool
+	// Messages routed as <prefix>.<shard>.<key>, which MQTT clients see and
+	// send as <prefix>.<key> and the bridge shards on the way back
+	shards int
+}
+
+var bridgedPrefixes = []bridgedPrefix{
+	{
+		prefix:      routing.ArmyMovesPrefix,
+		contentType: "application/json",
+		opts: []pubsub.PublishOption{
+			pubsub.WithExpiration(routing.ArmyMovesTTL),
+			pubsub.WithPriority(routing.ArmyMovePriority),
+		},
+		serverOnly: true,
+	},
+	{
+		prefix:      routing.WarRecognitionsPrefix,
+		contentType: "application/json",
+		serverOnly:  true,
+	},
+	{
+		prefix:      routing.GameLogSlug,
+		contentType: "application/gob",
+		shards:      routing.GameLogShards,
+	},
+}
+
+// mqttKey is the key the MQTT topic for key is built from, with the shard
+// number left out.
+func (bp bridgedPrefix) mqttKey(key string) string {
+	if bp.shards == 0 {
+		return key
+	}
+	rest, ok := strings.CutPrefix(key, bp.prefix+".")
+	if !ok {
+		return key
+	}
+	_, unsharded, ok := strings.Cut(rest, ".")
+	if !ok {
+		return key
+	}
+	return bp.prefix + "." + unsharded
+}
+
+// rabbitKey is the routing key for a message MQTT clients sent with key,
+// sharded if bp is. It reports false for keys outside bp.
+func (bp bridgedPrefix) rabbitKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, bp.prefix+".")
+	if !ok || rest == "" {
+		return "", false
+	}
+	if bp.shards == 0 {
+		return key, true
+	}
+	if strings.Contains(rest, ".") {
+		return "", false
+	}
+	return pubsub.ShardKey(bp.prefix, bp.shards, rest), true
+}
+
+// publisher sends a message on to RabbitMQ.
+type publisher func(exchange, key string, msg amqp091.Publishing) error
+
+func main() {
+	fmt.Println("Starting Peril MQTT bridge...")
+
+	connection, channel, err := pubsub.ConnectToRabbitMQ()
+	if err != nil {
+		fmt.Printf("Error connecting to RabbitMQ: %v", err)
+		return
+	}
+	defer connection.Close()
+
+	brokerURL := os.Getenv("PERIL_MQTT_URL")
+	if brokerURL == "" {
+		brokerURL = mqtt.DefaultBrokerURL
+	}
+	client, err := mqtt.Connect(brokerURL, fmt.Sprintf("peril_bridge_%d", os.Getpid()))
+	if err != nil {
+		fmt.Printf("Error connecting to MQTT broker: %v", err)
+		return
+	}
+	defer client.Disconnect(250)
+
+	for _, bp := range bridgedPrefixes {
+		if err := forwardToMQTT(connection, client, bp); err != nil {
+			fmt.Printf("Error bridging %s to MQTT: %v", bp.prefix, err)
+			return
+		}
+		if bp.serverOnly {
+			fmt.Printf("Bridging %s.* -> %s\n", bp.prefix, mqtt.Topic(routing.ExchangePerilTopic, bp.prefix+".#"))
+			continue
+		}
+		publish := func(exchange, key string, msg amqp091.Publishing) error {
+			return channel.Publish(exchange, key, false, false, msg)
+		}
+		if err := forwardToRabbitMQ(client, publish, bp); err != nil {
+			fmt.Printf("Error bridging %s from MQTT: %v", bp.prefix, err)
+			return
+		}
+		fmt.Printf("Bridging %s.* <-> %s\n", bp.prefix, mqtt.Topic(routing.ExchangePerilTopic, bp.prefix+".#"))
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	fmt.Println("Shutting down Peril MQTT bridge...")
+}
+
+// forwardToMQTT copies every message under bp.prefix on the topic exchange
+// to the matching MQTT topic, body untouched.
+func forwardToMQTT(conn *amqp091.Connection, client paho.Client, bp bridgedPrefix) error {
+	queueName := fmt.Sprintf("mqtt_bridge.%s.%d", bp.prefix, os.Getpid())
+	ch, _, err := pubsub.DeclareAndBind(
+		conn,
+		routing.ExchangePerilTopic,
+		queueName,
+		bp.prefix+".#",
+		pubsub.Transient,
+	)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := ch.Consume(queueName, "", false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+
+	go func() {
+		for d := range deliveries {
+			topic := mqtt.Topic(d.Exchange, bp.mqttKey(d.RoutingKey))
+			if err := mqtt.Publish(client, topic, d.Body); err != nil {
+				fmt.Printf("error forwarding %s to MQTT (will requeue): %v\n", d.RoutingKey, err)
+				d.Nack(false, true)
+				continue
+			}
+			d.Ack(false)
+		}
+	}()
+	return nil
+}
+
+// forwardToRabbitMQ publishes what MQTT clients send to the inbound topics
+// onto the topic exchange with the prefix's content type restored.
+func forwardToRabbitMQ(client paho.Client, publish publisher, bp bridgedPrefix) error {
+	filter := mqtt.InboundTopic(routing.ExchangePerilTopic, bp.prefix+".#")
+	token := client.Subscribe(filter, 1, func(_ paho.Client, message paho.Message) {
+		exchange, key, err := mqtt.ParseTopic(message.Topic())
+		if err == nil {
+			var ok bool
+			if key, ok = bp.rabbitKey(key); !ok {
+				err = fmt.Errorf("not a %s topic", bp.prefix)
+			}
+		}
+		if err != nil {
+			fmt.Printf("ignoring message on %s\n", message.Topic())
+			message.Ack()
+			return
+		}
+
+		msg := amqp091.Publishing{
+			ContentType: bp.contentType,
+			Body:        message.Payload(),
+		}
+		for _, opt := range bp.opts {
+			opt(&msg)
+		}
+		if err := publish(exchange, key, msg); err != nil {
+			// Unacked, so the session redelivers it
+			fmt.Printf("error forwarding %s to RabbitMQ: %v\n", key, err)
+			return
+		}
+		message.Ack()
+	})
+	token.Wait()
+	return token.Error()
+}
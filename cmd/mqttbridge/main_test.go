@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/mqtt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/mqtt/mqtttest"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+func gameLogs() bridgedPrefix {
+	for _, bp := range bridgedPrefixes {
+		if bp.prefix == routing.GameLogSlug {
+			return bp
+		}
+	}
+	panic("game logs aren't bridged")
+}
+
+func TestKeys(t *testing.T) {
+	logs := gameLogs()
+	aliceKey := pubsub.ShardKey(routing.GameLogSlug, routing.GameLogShards, "alice")
+	moves := bridgedPrefix{prefix: routing.ArmyMovesPrefix}
+
+	if got := logs.mqttKey(aliceKey); got != "game_logs.alice" {
+		t.Errorf("mqttKey(%q) = %q, want game_logs.alice", aliceKey, got)
+	}
+	if got := moves.mqttKey("army_moves.alice"); got != "army_moves.alice" {
+		t.Errorf("mqttKey(army_moves.alice) = %q", got)
+	}
+
+	tests := []struct {
+		bp   bridgedPrefix
+		key  string
+		want string
+		ok   bool
+	}{
+		{logs, "game_logs.alice", aliceKey, true},
+		{logs, "game_logs.0.alice", "", false},
+		{logs, "game_logs.", "", false},
+		{logs, "army_moves.alice", "", false},
+		{moves, "army_moves.alice", "army_moves.alice", true},
+	}
+	for _, tc := range tests {
+		got, ok := tc.bp.rabbitKey(tc.key)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("rabbitKey(%q) = %q, %v, want %q, %v", tc.key, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+type published struct {
+	exchange, key string
+	msg           amqp091.Publishing
+}
+
+func TestGameLogFromMQTT(t *testing.T) {
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	bridge, err := mqtt.Connect(broker.URL(), "bridge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bridge.Disconnect(0)
+	player, err := mqtt.Connect(broker.URL(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Disconnect(0)
+
+	sent := make(chan published, 1)
+	err = forwardToRabbitMQ(bridge, func(exchange, key string, msg amqp091.Publishing) error {
+		sent <- published{exchange, key, msg}
+		return nil
+	}, gameLogs())
+	if err != nil {
+		t.Fatalf("bridging: %v", err)
+	}
+
+	log := routing.GameLog{Username: "alice", Message: "hello"}
+	if err := mqtt.PublishGob(player, routing.ExchangePerilTopic, "game_logs.alice", log); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+
+	select {
+	case p := <-sent:
+		want := pubsub.ShardKey(routing.GameLogSlug, routing.GameLogShards, "alice")
+		if p.exchange != routing.ExchangePerilTopic || p.key != want {
+			t.Errorf("forwarded to %s/%s, want %s/%s", p.exchange, p.key, routing.ExchangePerilTopic, want)
+		}
+		if p.msg.ContentType != "application/gob" {
+			t.Errorf("content type %q, want application/gob", p.msg.ContentType)
+		}
+		var got routing.GameLog
+		if err := gob.NewDecoder(bytes.NewReader(p.msg.Body)).Decode(&got); err != nil || got.Message != log.Message {
+			t.Errorf("forwarded %+v (%v), want %+v", got, err, log)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the log never reached RabbitMQ")
+	}
+}
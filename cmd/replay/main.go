@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// Replays the match history recorded by the server, then keeps following it.
+// Usage: replay [first|last|next|<offset>|<RFC 3339 time>]
+func main() {
+	offset := pubsub.StreamFirst
+	if len(os.Args) > 1 {
+		var err error
+		offset, err = pubsub.ParseStreamOffset(os.Args[1])
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Println("Starting Peril replay...")
+
+	connection, _, err := pubsub.ConnectToRabbitMQ()
+	if err != nil {
+		fmt.Printf("Error connecting to RabbitMQ: %v", err)
+		return
+	}
+	defer connection.Close()
+
+	err = pubsub.SubscribeStreamJSON(
+		connection,
+		routing.ExchangePerilTopic,
+		routing.ArmyMovesHistoryStream,
+		routing.ArmyMovesPrefix+".*",
+		offset,
+		handlerMove(),
+		pubsub.WithMaxAge(routing.HistoryMaxAge),
+	)
+	if err != nil {
+		fmt.Printf("Error replaying moves: %v", err)
+		return
+	}
+
+	err = pubsub.SubscribeStreamJSON(
+		connection,
+		routing.ExchangePerilTopic,
+		routing.WarHistoryStream,
+		routing.WarRecognitionsPrefix+".#",
+		offset,
+		handlerWar(),
+		pubsub.WithMaxAge(routing.HistoryMaxAge),
+	)
+	if err != nil {
+		fmt.Printf("Error replaying wars: %v", err)
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	fmt.Println("Shutting down Peril replay...")
+}
+
+func handlerMove() func(gamelogic.ArmyMove) pubsub.AckType {
+	return func(move gamelogic.ArmyMove) pubsub.AckType {
+		fmt.Printf("[move] %s moved %d unit(s) to %s\n", move.Player.Username, len(move.Units), move.ToLocation)
+		return pubsub.Ack
+	}
+}
+
+func handlerWar() func(gamelogic.WarResolved) pubsub.AckType {
+	return func(war gamelogic.WarResolved) pubsub.AckType {
+		for _, battle := range war.Battles {
+			fmt.Printf("[war] %s\n", battle.LogMessage())
+		}
+		return pubsub.Ack
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/auth"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/outbox"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// worldFile holds the canonical game state and the deltas not yet relayed.
+// It is the only copy, so every server that may lead must see the same
+// file, e.g. on a volume they all mount (PERIL_WORLD_FILE); a leader that
+// finds no file starts an empty world. Only one server at a time can hold
+// it open.
+const worldFile = "peril_world.outbox.json"
+
+var errNotLeader = errors.New("this server is not the leader")
+
+// authority owns every player's units while this server is the leader. It
+// validates the players' commands, saves the result together with the
+// messages announcing it, and only then updates the world.
+type authority struct {
+	conn   *amqp091.Connection
+	paused *atomic.Bool
+	rules  *gamelogic.Rules
+	// secret player tokens are signed with
+	secret string
+
+	mu        sync.Mutex
+	world     *gamelogic.World
+	store     *outbox.Store
+	channels  []*amqp091.Channel
+	stopRelay context.CancelFunc
+	// wars waiting out routing.BattleDelay, by attacker, and the timers
+	// that will fight them
+	wars   map[string]pendingWar
+	timers map[string]*time.Timer
+}
+
+// savedGame is what the leader keeps in worldFile.
+type savedGame struct {
+	Players map[string]gamelogic.Player
+	Wars    []pendingWar
+}
+
+func newAuthority(conn *amqp091.Connection, paused *atomic.Bool, rules *gamelogic.Rules, secret string) *authority {
+	return &authority{
+		conn:   conn,
+		paused: paused,
+		rules:  rules,
+		secret: secret,
+	}
+}
+
+// start loads the world and begins answering commands.
+func (a *authority) start() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	store, err := outbox.Open(worldPath())
+	if err != nil {
+		return err
+	}
+	saved := savedGame{}
+	if _, err := store.State(&saved); err != nil {
+		store.Close()
+		return fmt.Errorf("could not restore game state: %v", err)
+	}
+	a.world = gamelogic.NewWorld(a.rules, saved.Players)
+	a.store = store
+	a.wars = map[string]pendingWar{}
+	a.timers = map[string]*time.Timer{}
+
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	a.stopRelay = stopRelay
+	go outbox.NewRelay(a.conn, store).Run(relayCtx)
+
+	err = serve(a, routing.SpawnRPCKey, a.handlerSpawn)
+	if err == nil {
+		err = serve(a, routing.MoveRPCKey, a.handlerMove)
+	}
+	if err == nil {
+		err = serve(a, routing.RetreatRPCKey, a.handlerRetreat)
+	}
+	if err == nil {
+		err = serve(a, routing.ReinforceRPCKey, a.handlerReinforce)
+	}
+	if err == nil {
+		err = serve(a, routing.FortifyRPCKey, a.handlerFortify)
+	}
+	if err == nil {
+		err = serve(a, routing.PlayerStateRPCKey, a.handlerPlayerState)
+	}
+	if err != nil {
+		a.stopLocked()
+		return err
+	}
+	fmt.Printf("Loaded the game state of %d player(s)\n", len(saved.Players))
+
+	// Wars the last leader didn't get to fight
+	for _, war := range saved.Wars {
+		a.wars[war.Attacker] = war
+		a.armWar(war)
+	}
+
+	// Players already connected learn right away if their rules differ
+	if err := a.announceRules(); err != nil {
+		fmt.Printf("error announcing ruleset: %v\n", err)
+	}
+	return nil
+}
+
+func worldPath() string {
+	if path := os.Getenv("PERIL_WORLD_FILE"); path != "" {
+		return path
+	}
+	return worldFile
+}
+
+func (a *authority) announceRules() error {
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return pubsub.PublishJSON(ch, routing.ExchangePerilDirect, routing.RulesKey, routing.RulesetInfo{
+		Version: a.rules.Version,
+		Hash:    a.rules.Hash(),
+	})
+}
+
+func serve[Req, Resp any](a *authority, key string, handler func(Req) (Resp, error)) error {
+	ch, err := pubsub.ServeJSON(a.conn, routing.ExchangePerilDirect, key, key, pubsub.Durable, handler)
+	if err != nil {
+		return fmt.Errorf("could not serve %s: %v", key, err)
+	}
+	a.channels = append(a.channels, ch)
+	return nil
+}
+
+// stop gives up the commands to the next leader. Requests being handled
+// are requeued for it.
+func (a *authority) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopLocked()
+}
+
+func (a *authority) stopLocked() {
+	for _, ch := range a.channels {
+		ch.Close()
+	}
+	a.channels = nil
+	for _, timer := range a.timers {
+		timer.Stop()
+	}
+	a.timers = nil
+	a.wars = nil
+	if a.stopRelay != nil {
+		a.stopRelay()
+		a.stopRelay = nil
+	}
+	a.world = nil
+	if a.store != nil {
+		a.store.Close()
+		a.store = nil
+	}
+}
+
+func (a *authority) handlerSpawn(cmd gamelogic.SpawnCommand) (gamelogic.StateDelta, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkCommand(cmd.Username, cmd.Token, cmd.RulesHash); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+
+	delta, err := a.world.Spawn(cmd)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	if err := a.commit([]gamelogic.StateDelta{delta}, a.wars); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	fmt.Printf("%s spawned a(n) %s in %s\n", cmd.Username, cmd.Rank, cmd.Location)
+	return delta, nil
+}
+
+func (a *authority) handlerMove(cmd gamelogic.MoveCommand) (gamelogic.StateDelta, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMove(cmd.Username, cmd.Token, cmd.RulesHash); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+
+	move, delta, err := a.world.Move(cmd)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	if err := a.commitMove(move, delta, true); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	fmt.Printf("%s moved %d unit(s) to %s\n", cmd.Username, len(move.Units), cmd.ToLocation)
+	return delta, nil
+}
+
+func (a *authority) handlerRetreat(cmd gamelogic.RetreatCommand) (gamelogic.StateDelta, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMove(cmd.Username, cmd.Token, cmd.RulesHash); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+
+	move, delta, err := a.world.Retreat(cmd)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	if err := a.commitMove(move, delta, true); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	fmt.Printf("%s retreated %d unit(s) from %s to %s\n", cmd.Username, len(move.Units), cmd.From, cmd.To)
+	return delta, nil
+}
+
+func (a *authority) handlerReinforce(cmd gamelogic.ReinforceCommand) (gamelogic.StateDelta, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMove(cmd.Username, cmd.Token, cmd.RulesHash); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+
+	if !a.warPendingAt(cmd.Location) {
+		return gamelogic.StateDelta{}, fmt.Errorf("error: there is no battle about to be fought in %s", cmd.Location)
+	}
+
+	// Reinforcements join the war already waiting rather than start one
+	move, delta, err := a.world.Reinforce(cmd)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	if err := a.commitMove(move, delta, false); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	fmt.Printf("%s reinforced %s with %d unit(s)\n", cmd.Username, cmd.Location, len(move.Units))
+	return delta, nil
+}
+
+func (a *authority) handlerFortify(cmd gamelogic.FortifyCommand) (gamelogic.StateDelta, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkMove(cmd.Username, cmd.Token, cmd.RulesHash); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+
+	delta, err := a.world.Fortify(cmd)
+	if err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	if err := a.commit([]gamelogic.StateDelta{delta}, a.wars); err != nil {
+		return gamelogic.StateDelta{}, err
+	}
+	fmt.Printf("%s fortified %d unit(s) in %s\n", cmd.Username, len(delta.Units), cmd.Location)
+	return delta, nil
+}
+
+// checkCommand rejects commands this server can't take, or that come from
+// someone other than the player they name or with different rules.
+func (a *authority) checkCommand(username, token, rulesHash string) error {
+	if a.world == nil {
+		return errNotLeader
+	}
+	if err := auth.Check(a.secret, username, token); err != nil {
+		return err
+	}
+	return a.rules.CheckHash(rulesHash)
+}
+
+// checkMove rejects commands that change the board when they can't be
+// carried out right now.
+func (a *authority) checkMove(username, token, rulesHash string) error {
+	if err := a.checkCommand(username, token, rulesHash); err != nil {
+		return err
+	}
+	if a.paused.Load() {
+		return errors.New("the game is paused, you can not move units")
+	}
+	return nil
+}
+
+// commitMove saves and announces move. If startsWar is set and the move
+// takes the player onto contested ground that no war is waiting on yet, it
+// schedules one there.
+func (a *authority) commitMove(move gamelogic.ArmyMove, delta gamelogic.StateDelta, startsWar bool) error {
+	announce, err := pubsub.EncodeJSON(
+		move,
+		pubsub.WithExpiration(routing.ArmyMovesTTL),
+		pubsub.WithPriority(routing.ArmyMovePriority),
+	)
+	if err != nil {
+		return err
+	}
+
+	wars := a.wars
+	war, started := pendingWar{}, false
+	if startsWar {
+		war, started = a.startWar(delta)
+	}
+	if started {
+		wars = maps.Clone(a.wars)
+		wars[war.Attacker] = war
+	}
+
+	err = a.commit([]gamelogic.StateDelta{delta}, wars, outbox.Message{
+		Exchange:   routing.ExchangePerilTopic,
+		Key:        routing.ArmyMovesPrefix + "." + delta.Username,
+		Publishing: announce,
+	})
+	if err != nil {
+		return err
+	}
+	if started {
+		a.armWar(war)
+	}
+	return nil
+}
+
+func (a *authority) handlerPlayerState(req routing.PlayerStateRequest) (gamelogic.Player, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.checkCommand(req.Username, req.Token, req.RulesHash); err != nil {
+		if err != errNotLeader {
+			fmt.Printf("Rejected %s: %v\n", req.Username, err)
+		}
+		return gamelogic.Player{}, err
+	}
+	return a.world.Player(req.Username), nil
+}
+
+// commit saves the world as it will be after deltas and the wars waiting to
+// be fought, along with the deltas for the players' views and any other
+// messages, then applies them.
+func (a *authority) commit(deltas []gamelogic.StateDelta, wars map[string]pendingWar, msgs ...outbox.Message) error {
+	updates := []outbox.Message{}
+	for _, delta := range deltas {
+		msg, err := pubsub.EncodeJSON(delta)
+		if err != nil {
+			return err
+		}
+		updates = append(updates, outbox.Message{
+			Exchange:   routing.ExchangePerilTopic,
+			Key:        routing.StateDeltaPrefix + "." + delta.Username,
+			Publishing: msg,
+		})
+	}
+
+	saved := savedGame{
+		Players: a.world.Preview(deltas...),
+		Wars:    []pendingWar{},
+	}
+	for _, war := range wars {
+		saved.Wars = append(saved.Wars, war)
+	}
+	if err := a.store.Commit(saved, append(updates, msgs...)...); err != nil {
+		return fmt.Errorf("could not save game state: %v", err)
+	}
+	for _, delta := range deltas {
+		a.world.Apply(delta)
+	}
+	a.wars = wars
+	return nil
+}
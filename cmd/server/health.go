@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// A consumer this far behind means the server can't keep up
+const maxConsumerLag = 1000
+
+type readiness struct {
+	Ready     bool                    `json:"ready"`
+	Connected bool                    `json:"connected"`
+	Topology  bool                    `json:"topology"`
+	Consumers []pubsub.ConsumerStatus `json:"consumers"`
+	Problems  []string                `json:"problems,omitempty"`
+}
+
+// serveHealth exposes /healthz (the process is up) and /readyz (the server
+// is connected, set up and keeping up with its queues) on addr.
+func serveHealth(addr string, connection *amqp091.Connection, topology *atomic.Bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := checkReadiness(connection, topology)
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("error serving health checks: %v\n", err)
+		}
+	}()
+}
+
+func checkReadiness(connection *amqp091.Connection, topology *atomic.Bool) readiness {
+	status := readiness{
+		Connected: !connection.IsClosed(),
+		Topology:  topology.Load(),
+		Consumers: []pubsub.ConsumerStatus{},
+	}
+	if !status.Connected {
+		status.Problems = append(status.Problems, "not connected to the broker")
+	}
+	if !status.Topology {
+		status.Problems = append(status.Problems, "topology not declared yet")
+	}
+
+	if status.Connected {
+		consumers, err := pubsub.Consumers(connection)
+		if err != nil {
+			status.Problems = append(status.Problems, err.Error())
+		} else {
+			status.Consumers = consumers
+		}
+	}
+	if len(status.Consumers) == 0 {
+		status.Problems = append(status.Problems, "no active consumers")
+	}
+	for _, c := range status.Consumers {
+		if c.Lag > maxConsumerLag {
+			status.Problems = append(status.Problems, fmt.Sprintf("%s is %d messages behind", c.Queue, c.Lag))
+		}
+	}
+
+	status.Ready = len(status.Problems) == 0
+	return status
+}
@@ -1,16 +1,38 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/auth"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 	"github.com/rabbitmq/amqp091-go"
 )
 
+const shutdownTimeout = 10 * time.Second
+
+// Players prove who they are with a token signed with PERIL_AUTH_SECRET;
+// "server token <username>" prints one.
 func main() {
+	secret, err := auth.Secret()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(os.Args) == 3 && os.Args[1] == "token" {
+		fmt.Println(auth.Token(secret, os.Args[2]))
+		return
+	}
+
 	fmt.Println("Starting Peril server...")
 
 	connection, channel, err := pubsub.ConnectToRabbitMQ()
@@ -19,78 +41,342 @@ func main() {
 		return
 	}
 	fmt.Println("Connection was successful!")
-	defer connection.Close()
 	gamelogic.PrintServerHelp()
 
-	_, _, err = pubsub.DeclareAndBind(
+	// Optional health checks, e.g. PERIL_HEALTH_ADDR=:8081
+	topology := &atomic.Bool{}
+	if addr := os.Getenv("PERIL_HEALTH_ADDR"); addr != "" {
+		serveHealth(addr, connection, topology)
+		fmt.Printf("Serving health checks on %s\n", addr)
+	}
+
+	// Stop reacting to the REPL and broker once asked to shut down
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	logThrottle := pubsub.NewKeyedRateLimiter(routing.GameLogConsumeRate, routing.GameLogConsumeBurst)
+	gameLogQueueOpts := []pubsub.QueueOption{
+		pubsub.WithMaxLength(routing.GameLogsMaxLength),
+		pubsub.WithOverflow(pubsub.OverflowDropHead),
+		pubsub.WithDeliveryLimit(routing.GameLogDeliveryLimit),
+	}
+
+	// Record moves and wars for replay
+	if err := declareHistory(connection); err != nil {
+		fmt.Printf("Error declaring history streams: %v", err)
+		return
+	}
+
+	// Consume game logs from as many shards as we may claim; the others are
+	// left to the other servers, or picked up if one of them goes away
+	maxShards, err := maxLogShards()
+	if err != nil {
+		fmt.Printf("error: %v", err)
+		return
+	}
+	logShards := pubsub.ClaimShardsGob(
+		ctx,
 		connection,
 		routing.ExchangePerilTopic,
 		routing.GameLogSlug,
-		routing.GameLogSlug+".*",
-		pubsub.Durable,
+		routing.GameLogShards,
+		maxShards,
+		pubsub.Quorum,
+		handlerLog(logThrottle),
+		gameLogQueueOpts...,
+	)
+
+	// Track pause state, including resumes scheduled with a delay
+	playing := &playingState{}
+	err = pubsub.SubscribeJSON(
+		connection,
+		routing.ExchangePerilDirect,
+		fmt.Sprintf("%s.server.%d", routing.PauseKey, os.Getpid()),
+		routing.PauseKey,
+		pubsub.Transient,
+		handlerTrackPause(playing),
 	)
 	if err != nil {
-		fmt.Printf("Error declaring/binding to queue: %v", err)
+		fmt.Printf("Error subscribing to pause channel: %v", err)
 		return
 	}
 
-	// Subscribe to logs
-	err = pubsub.SubscribeGob(
+	// Answer clients asking whether the game is paused
+	_, err = pubsub.ServeJSON(
 		connection,
-		string(routing.ExchangePerilDirect), //exchange?
-		string(routing.GameLogSlug),
-		string(routing.GameLogSlug)+".*",
+		routing.ExchangePerilDirect,
+		routing.PlayingStateRPCKey,
+		routing.PlayingStateRPCKey,
 		pubsub.Durable,
-		handlerLog(),
+		handlerPlayingState(playing),
 	)
 	if err != nil {
-		fmt.Printf("Error subscribing to logs channel: %v", err)
+		fmt.Printf("Error serving playing state requests: %v", err)
 		return
 	}
 
+	// Only the leader controls the game and holds the canonical game state;
+	// every server ingests logs
+	rules, err := gamelogic.LoadActiveRules()
+	if err != nil {
+		fmt.Printf("error: %v", err)
+		return
+	}
+	fmt.Printf("Using ruleset %s\n", rules.ShortHash())
+	game := newAuthority(connection, &playing.paused, rules, secret)
+	election := pubsub.ElectLeader(ctx, connection, routing.LeaderQueue, func(leader bool) error {
+		if leader {
+			fmt.Println("This server is now the leader and controls the game.")
+			if err := game.start(); err != nil {
+				return fmt.Errorf("error taking over the game state: %v", err)
+			}
+		} else {
+			fmt.Println("This server is no longer the leader.")
+			game.stop()
+		}
+		return nil
+	})
+
+	topology.Store(true)
+
 	// REPL
+	inputs, next := gamelogic.ReadInputs()
+repl:
 	for {
-		input := gamelogic.GetInput()
+		next()
+		var input []string
+		select {
+		case sig := <-signals:
+			fmt.Printf("\nReceived %v\n", sig)
+			break repl
+		case words, ok := <-inputs:
+			if !ok {
+				// No terminal (e.g. multiserver.sh), keep serving until signalled
+				inputs = nil
+				continue
+			}
+			input = words
+		}
 		if len(input) == 0 {
 			continue
 		}
 		word := input[0]
-		if word == "pause" {
+		if (word == "pause" || word == "resume") && !election.IsLeader() {
+			fmt.Println("Another server is the leader; only it can pause or resume the game.")
+		} else if word == "pause" {
+			resumeAfter, err := parseDelay(input)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
 			fmt.Println("Pausing the game...")
-			if err := ToggleGameState(channel, true); err != nil {
+			issued := time.Now()
+			if err := ToggleGameState(channel, true, issued); err != nil {
 				fmt.Printf("error: %v", err)
 				os.Exit(1)
 			}
+			if resumeAfter > 0 {
+				fmt.Printf("The game will resume in %v\n", resumeAfter)
+				if err := ScheduleGameState(channel, false, issued, resumeAfter); err != nil {
+					fmt.Printf("error scheduling resume: %v\n", err)
+				}
+			}
 
 		} else if word == "resume" {
+			resumeAfter, err := parseDelay(input)
+			if err != nil {
+				fmt.Printf("error: %v\n", err)
+				continue
+			}
+			if resumeAfter > 0 {
+				fmt.Printf("The game will resume in %v\n", resumeAfter)
+				if err := ScheduleGameState(channel, false, time.Now(), resumeAfter); err != nil {
+					fmt.Printf("error scheduling resume: %v\n", err)
+				}
+				continue
+			}
 			fmt.Println("Resuming the game...")
-			if err := ToggleGameState(channel, false); err != nil {
+			if err := ToggleGameState(channel, false, time.Now()); err != nil {
 				fmt.Printf("error: %v", err)
 				os.Exit(1)
 			}
+		} else if word == "leader" {
+			if election.IsLeader() {
+				fmt.Println("This server is the leader.")
+			} else {
+				fmt.Println("This server is a follower.")
+			}
+		} else if word == "shards" {
+			fmt.Printf("Consuming game log shards %v of %d\n", logShards.Claimed(), routing.GameLogShards)
+		} else if word == "offenders" {
+			printOffenders(logThrottle)
 		} else if word == "quit" {
 			fmt.Println("Exiting the game...")
-			break
+			break repl
 		} else {
 			fmt.Println("Please type a valid command.")
 		}
 	}
 
 	fmt.Println("Shutting down Peril server...")
+	os.Exit(shutdown(connection, stop))
 }
 
-func ToggleGameState(channel *amqp091.Channel, pause bool) error {
+// shutdown lets in-flight handlers (e.g. a log mid-write) finish before
+// closing the connection, and returns the process exit status. Shard
+// claims and the leader lease are only given up once the handlers are done,
+// since releasing them closes the channels the handlers ack on.
+func shutdown(connection *amqp091.Connection, release context.CancelFunc) int {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	status := 0
+	if err := pubsub.Shutdown(ctx); err != nil {
+		fmt.Printf("error draining consumers: %v\n", err)
+		status = 1
+	}
+	release()
+	if err := connection.Close(); err != nil {
+		fmt.Printf("error closing connection: %v\n", err)
+		status = 1
+	}
+	return status
+}
+
+func declareHistory(conn *amqp091.Connection) error {
+	streams := map[string]string{
+		routing.ArmyMovesHistoryStream: routing.ArmyMovesPrefix + ".*",
+		routing.WarHistoryStream:       routing.WarRecognitionsPrefix + ".#",
+	}
+	for stream, key := range streams {
+		ch, _, err := pubsub.DeclareAndBind(
+			conn,
+			routing.ExchangePerilTopic,
+			stream,
+			key,
+			pubsub.Stream,
+			pubsub.WithMaxAge(routing.HistoryMaxAge),
+		)
+		if err != nil {
+			return err
+		}
+		ch.Close()
+	}
+	return nil
+}
+
+// ToggleGameState pauses or resumes the game now, cancelling any resume
+// scheduled before issued.
+func ToggleGameState(channel *amqp091.Channel, pause bool, issued time.Time) error {
 	return pubsub.PublishJSON(
 		channel,
 		routing.ExchangePerilDirect,
 		routing.PauseKey,
-		routing.PlayingState{IsPaused: pause},
+		routing.PlayingState{IsPaused: pause, Issued: issued},
+		pubsub.WithPriority(routing.PlayingStatePriority),
+	)
+}
+
+// ScheduleGameState pauses or resumes the game after delay, unless another
+// pause or resume is issued after issued in the meantime.
+func ScheduleGameState(channel *amqp091.Channel, pause bool, issued time.Time, delay time.Duration) error {
+	return pubsub.PublishDelayedJSON(
+		channel,
+		routing.ExchangePerilDirect,
+		routing.PauseKey,
+		delay,
+		routing.PlayingState{IsPaused: pause, Issued: issued},
+		pubsub.WithPriority(routing.PlayingStatePriority),
 	)
 }
 
-func handlerLog() func(routing.GameLog) pubsub.AckType {
+func parseDelay(input []string) (time.Duration, error) {
+	if len(input) < 2 {
+		return 0, nil
+	}
+	delay, err := time.ParseDuration(input[1])
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid duration (e.g. 30s, 5m)", input[1])
+	}
+	return delay, nil
+}
+
+// playingState is the latest pause or resume this server has seen.
+type playingState struct {
+	paused atomic.Bool
+
+	mu     sync.Mutex
+	latest routing.PlayingState
+}
+
+// set takes ps unless it was issued before the latest pause or resume.
+func (p *playingState) set(ps routing.PlayingState) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !ps.Supersedes(p.latest) {
+		return false
+	}
+	p.latest = ps
+	p.paused.Store(ps.IsPaused)
+	return true
+}
+
+func (p *playingState) get() routing.PlayingState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latest
+}
+
+func handlerTrackPause(playing *playingState) func(routing.PlayingState) pubsub.AckType {
+	return func(ps routing.PlayingState) pubsub.AckType {
+		if !playing.set(ps) {
+			fmt.Println("Ignoring a resume cancelled by a later pause or resume")
+		}
+		return pubsub.Ack
+	}
+}
+
+// maxLogShards reads PERIL_MAX_LOG_SHARDS so several servers can split the
+// game log shards between them instead of the first one taking all of them.
+// Without it, PERIL_INSTANCES servers each take an even share.
+func maxLogShards() (int, error) {
+	if env := os.Getenv("PERIL_MAX_LOG_SHARDS"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("PERIL_MAX_LOG_SHARDS must be a positive integer, got %q", env)
+		}
+		return n, nil
+	}
+	if env := os.Getenv("PERIL_INSTANCES"); env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("PERIL_INSTANCES must be a positive integer, got %q", env)
+		}
+		return (routing.GameLogShards + n - 1) / n, nil
+	}
+	return routing.GameLogShards, nil
+}
+
+func printOffenders(throttle *pubsub.KeyedRateLimiter) {
+	offenders := throttle.Offenders()
+	if len(offenders) == 0 {
+		fmt.Println("No players have exceeded the game log quota.")
+		return
+	}
+	fmt.Println("Players over the game log quota:")
+	for _, o := range offenders {
+		fmt.Printf("* %s: %d log(s) rejected\n", o.Key, o.Rejected)
+	}
+}
+
+func handlerLog(throttle *pubsub.KeyedRateLimiter) func(routing.GameLog) pubsub.AckType {
 	return func(gamelog routing.GameLog) pubsub.AckType {
 		defer fmt.Print("> ")
+		if ok, rejected := throttle.Allow(gamelog.Username); !ok {
+			fmt.Printf("%s is over the game log quota (%d rejected), dead-lettering log\n", gamelog.Username, rejected)
+			return pubsub.NackDiscard
+		}
 		err := gamelogic.WriteLog(gamelog)
 		if err != nil {
 			fmt.Printf("error handling log: %v\n", err)
@@ -99,3 +385,10 @@ func handlerLog() func(routing.GameLog) pubsub.AckType {
 		return pubsub.Ack
 	}
 }
+
+func handlerPlayingState(playing *playingState) func(routing.PlayingStateRequest) (routing.PlayingState, error) {
+	return func(req routing.PlayingStateRequest) (routing.PlayingState, error) {
+		fmt.Printf("%s requested the playing state\n", req.Username)
+		return playing.get(), nil
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/gamelogic"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/outbox"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+// pendingWar is a war waiting out routing.BattleDelay so everyone can
+// retreat, reinforce or fortify before it's fought. It's saved with the
+// world so the next leader fights it if this one goes away.
+type pendingWar struct {
+	Attacker  string
+	Locations []gamelogic.Location
+	Due       time.Time
+}
+
+// startWar is the war delta's player starts on contested ground no war is
+// waiting on yet. An attacker only has one war waiting at a time, so one
+// that's already waiting takes in the new locations and keeps its time.
+func (a *authority) startWar(delta gamelogic.StateDelta) (pendingWar, bool) {
+	locs := []gamelogic.Location{}
+	for _, loc := range a.world.ContestedAfter(delta) {
+		if !a.warPendingAt(loc) {
+			locs = append(locs, loc)
+		}
+	}
+	if len(locs) == 0 {
+		return pendingWar{}, false
+	}
+
+	war, waiting := a.wars[delta.Username]
+	if !waiting {
+		war = pendingWar{
+			Attacker: delta.Username,
+			Due:      time.Now().Add(routing.BattleDelay),
+		}
+	}
+	war.Locations = append(slices.Clone(war.Locations), locs...)
+	return war, true
+}
+
+func (a *authority) warPendingAt(loc gamelogic.Location) bool {
+	for _, war := range a.wars {
+		if slices.Contains(war.Locations, loc) {
+			return true
+		}
+	}
+	return false
+}
+
+// armWar sets a timer to fight war when it's due, unless one is set
+// already.
+func (a *authority) armWar(war pendingWar) {
+	if _, armed := a.timers[war.Attacker]; armed {
+		return
+	}
+	a.armWarAfter(war.Attacker, time.Until(war.Due))
+}
+
+func (a *authority) armWarAfter(attacker string, delay time.Duration) {
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.world == nil || a.timers[attacker] != timer {
+			return
+		}
+		delete(a.timers, attacker)
+		if err := a.fightWar(attacker); err != nil {
+			fmt.Printf("error fighting %s's war, trying again in %v: %v\n", attacker, routing.BattleDelay, err)
+			a.armWarAfter(attacker, routing.BattleDelay)
+		}
+	})
+	a.timers[attacker] = timer
+}
+
+// fightWar fights out attacker's waiting war and saves the result along
+// with the verdict. The seeds go out with the battles so the players can
+// replay them.
+func (a *authority) fightWar(attacker string) error {
+	wars := maps.Clone(a.wars)
+	delete(wars, attacker)
+
+	war, contested := a.world.War(attacker, a.wars[attacker].Locations, rand.Int63())
+	deltas := []gamelogic.StateDelta{}
+	msgs := []outbox.Message{}
+	if contested {
+		var err error
+		msgs, err = announceWar(war)
+		if err != nil {
+			return err
+		}
+		for _, battle := range war.Battles {
+			deltas = append(deltas, battle.Losses...)
+		}
+	}
+	if err := a.commit(deltas, wars, msgs...); err != nil {
+		return err
+	}
+	if contested {
+		fmt.Println(war.LogMessage())
+	}
+	return nil
+}
+
+// announceWar tells everyone the verdict and records it in the game logs.
+func announceWar(war gamelogic.WarResolved) ([]outbox.Message, error) {
+	verdict, err := pubsub.EncodeJSON(war)
+	if err != nil {
+		return nil, err
+	}
+	logKey, log, err := pubsub.EncodeGameLog(war.Attacker, war.LogMessage())
+	if err != nil {
+		return nil, err
+	}
+	return []outbox.Message{
+		{
+			Exchange:   routing.ExchangePerilTopic,
+			Key:        routing.WarRecognitionsPrefix + "." + war.Attacker,
+			Publishing: verdict,
+		},
+		{
+			Exchange:   routing.ExchangePerilTopic,
+			Key:        logKey,
+			Publishing: log,
+		},
+	}, nil
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Secret reads the secret player tokens are signed with from
+// PERIL_AUTH_SECRET. The servers and the gateway must share it.
+func Secret() (string, error) {
+	secret := os.Getenv("PERIL_AUTH_SECRET")
+	if secret == "" {
+		return "", errors.New("PERIL_AUTH_SECRET must be set")
+	}
+	return secret, nil
+}
+
+// Token is what username presents to prove who they are.
+func Token(secret, username string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check rejects a token that wasn't issued to username.
+func Check(secret, username, token string) error {
+	if !hmac.Equal([]byte(token), []byte(Token(secret, username))) {
+		return fmt.Errorf("invalid token for %s", username)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package gamelogic
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+)
+
+// Combat models a ruleset can pick
+const (
+	// CombatPower: each side deals its total power in damage, spread over
+	// the other sides' units in proportion to their health
+	CombatPower = "power"
+	// CombatDice: rounds of Risk-style dice where each lost roll costs the
+	// unit the winning unit's power in health, until one side is left
+	CombatDice = "dice"
+)
+
+const (
+	diceSides       = 6
+	maxAttackerDice = 3
+	maxDefenderDice = 2
+)
+
+// fight decides how much damage each side's units take at a contested
+// location, by unit ID, one map per side. It depends only on its arguments,
+// so anyone holding the battle message can replay it.
+func (r *Rules) fight(sides [][]Unit, seed int64) []map[int]int {
+	if r.Combat == CombatDice {
+		return r.fightWithDice(sides, seed)
+	}
+	return r.fightByPower(sides)
+}
+
+// fightByPower has every side deal its power to the others, split between
+// them in proportion to their total health.
+func (r *Rules) fightByPower(sides [][]Unit) []map[int]int {
+	health := []int{}
+	for _, units := range sides {
+		total := 0
+		for _, unit := range units {
+			total += unit.Health
+		}
+		health = append(health, total)
+	}
+
+	taken := make([]int, len(sides))
+	for i, units := range sides {
+		weights := append([]int{}, health...)
+		weights[i] = 0
+		for j, dealt := range apportion(r.PowerLevel(units), weights) {
+			taken[j] += dealt
+		}
+	}
+
+	// Fortified units shrug off some of their share
+	damage := []map[int]int{}
+	for i, units := range sides {
+		dealt := r.spread(units, taken[i])
+		for _, unit := range units {
+			dealt[unit.ID] = max(dealt[unit.ID]-r.fortification(unit), 0)
+		}
+		damage = append(damage, dealt)
+	}
+	return damage
+}
+
+// spread splits damage over units in proportion to their health.
+func (r *Rules) spread(units []Unit, damage int) map[int]int {
+	sorted := sortedByID(units)
+	weights := []int{}
+	for _, unit := range sorted {
+		weights = append(weights, unit.Health)
+	}
+	dealt := map[int]int{}
+	for i, d := range apportion(damage, weights) {
+		dealt[sorted[i].ID] = d
+	}
+	return dealt
+}
+
+// apportion splits total in proportion to weights. The remainder of the
+// split goes one point each to the largest shares, ties broken by position,
+// so the total dealt is exact. Nothing is dealt if all weights are 0.
+func apportion(total int, weights []int) []int {
+	shares := make([]int, len(weights))
+	sum := 0
+	for _, w := range weights {
+		sum += w
+	}
+	if sum == 0 {
+		return shares
+	}
+
+	left := total
+	order := []int{}
+	for i, w := range weights {
+		shares[i] = total * w / sum
+		left -= shares[i]
+		order = append(order, i)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return total*weights[order[a]]%sum > total*weights[order[b]]%sum
+	})
+	for i := 0; i < left && i < len(order); i++ {
+		shares[order[i]]++
+	}
+	return shares
+}
+
+type roll struct {
+	value int
+	unit  Unit
+}
+
+// fightWithDice goes round the sides in order, each still standing attacking
+// the next one standing with a round of dice, until at most one is left.
+func (r *Rules) fightWithDice(sides [][]Unit, seed int64) []map[int]int {
+	rng := rand.New(rand.NewSource(seed))
+
+	standing := [][]Unit{}
+	damage := []map[int]int{}
+	for _, units := range sides {
+		standing = append(standing, sortedByID(units))
+		damage = append(damage, map[int]int{})
+	}
+	left := func() []int {
+		list := []int{}
+		for i, units := range standing {
+			if len(units) > 0 {
+				list = append(list, i)
+			}
+		}
+		return list
+	}
+
+	hit := func(side int, unit Unit, by Unit) {
+		damage[side][unit.ID] += r.Ranks[by.Rank].Power
+		if damage[side][unit.ID] >= unit.Health {
+			standing[side] = without(standing[side], unit)
+		}
+	}
+	for sidesLeft := left(); len(sidesLeft) > 1; sidesLeft = left() {
+		for n, attacker := range sidesLeft {
+			defender := sidesLeft[(n+1)%len(sidesLeft)]
+			if len(standing[attacker]) == 0 || len(standing[defender]) == 0 {
+				continue
+			}
+
+			// The strongest units roll first
+			attacking := r.strongestFirst(standing[attacker], func(rr RankRules) int { return rr.Attack })
+			defending := r.strongestFirst(standing[defender], func(rr RankRules) int { return rr.Defense })
+			attackRolls := rollFor(rng, attacking[:min(maxAttackerDice, len(attacking))], func(u Unit) int { return r.Ranks[u.Rank].Attack })
+			defenseRolls := rollFor(rng, defending[:min(maxDefenderDice, len(defending))], func(u Unit) int { return r.Ranks[u.Rank].Defense + r.fortification(u) })
+
+			// Highest rolls face off; the defender wins ties
+			for i := 0; i < min(len(attackRolls), len(defenseRolls)); i++ {
+				if attackRolls[i].value > defenseRolls[i].value {
+					hit(defender, defenseRolls[i].unit, attackRolls[i].unit)
+				} else {
+					hit(attacker, attackRolls[i].unit, defenseRolls[i].unit)
+				}
+			}
+		}
+	}
+	return damage
+}
+
+func (r *Rules) strongestFirst(units []Unit, value func(RankRules) int) []Unit {
+	sorted := sortedByID(units)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return value(r.Ranks[sorted[i].Rank]) > value(r.Ranks[sorted[j].Rank])
+	})
+	return sorted
+}
+
+func rollFor(rng *rand.Rand, units []Unit, bonus func(Unit) int) []roll {
+	rolls := []roll{}
+	for _, unit := range units {
+		rolls = append(rolls, roll{value: rng.Intn(diceSides) + 1 + bonus(unit), unit: unit})
+	}
+	sort.SliceStable(rolls, func(i, j int) bool { return rolls[i].value > rolls[j].value })
+	return rolls
+}
+
+func without(units []Unit, dead Unit) []Unit {
+	return slices.DeleteFunc(units, func(u Unit) bool { return u.ID == dead.ID })
+}
+
+func sortedByID(units []Unit) []Unit {
+	sorted := append([]Unit{}, units...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+	return sorted
+}
+
+// casualties turns the damage dealt to one side into per-unit casualties,
+// in ID order.
+func (r *Rules) casualties(username string, units []Unit, damage map[int]int) []Casualty {
+	list := []Casualty{}
+	for _, unit := range sortedByID(units) {
+		dealt := min(damage[unit.ID], unit.Health)
+		if dealt == 0 {
+			continue
+		}
+		unit.Health -= dealt
+		list = append(list, Casualty{
+			Username: username,
+			Unit:     unit,
+			Damage:   dealt,
+			Killed:   unit.Health == 0,
+		})
+	}
+	return list
+}
+
+// CheckBattle replays b from the units and seed it carries and reports an
+// error if the server's casualties differ from the replay.
+func (r *Rules) CheckBattle(b BattleResolved) error {
+	damage := r.fight(b.unitsBySide(), b.Seed)
+	want := []Casualty{}
+	for i, side := range b.Sides {
+		want = append(want, r.casualties(side.Username, side.Units, damage[i])...)
+	}
+	if !slices.Equal(want, b.Casualties) {
+		return fmt.Errorf("replaying the battle gives casualties %v, not %v", want, b.Casualties)
+	}
+	return nil
+}
+
+// CheckWar replays every battle in war.
+func (r *Rules) CheckWar(war WarResolved) error {
+	for _, battle := range war.Battles {
+		if err := r.CheckBattle(battle); err != nil {
+			return fmt.Errorf("%s: %v", battle.Location, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package gamelogic
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestApportion(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int
+		weights []int
+		want    []int
+	}{
+		{"no weights", 10, []int{}, []int{}},
+		{"all weights zero", 10, []int{0, 0}, []int{0, 0}},
+		{"nothing to split", 0, []int{1, 2}, []int{0, 0}},
+		{"even split", 10, []int{1, 1}, []int{5, 5}},
+		{"zero weight gets nothing", 5, []int{0, 3, 2}, []int{0, 3, 2}},
+		{"remainder to largest share", 7, []int{1, 2}, []int{2, 5}},
+		{"remainder ties by position", 10, []int{1, 1, 1}, []int{4, 3, 3}},
+		{"less than one each", 2, []int{1, 1, 1}, []int{1, 1, 0}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := apportion(tc.total, tc.weights)
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("apportion(%d, %v) = %v, want %v", tc.total, tc.weights, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBattleReplaysFromSeed(t *testing.T) {
+	power := DefaultRules()
+	dice := *DefaultRules()
+	dice.Combat = CombatDice
+
+	twoSides := map[string]Player{
+		"alice": {Username: "alice", Units: map[int]Unit{
+			1: {ID: 1, Rank: RankArtillery, Location: "europe", Health: 8},
+			2: {ID: 2, Rank: RankCavalry, Location: "europe", Health: 5},
+		}},
+		"bob": {Username: "bob", Units: map[int]Unit{
+			1: {ID: 1, Rank: RankInfantry, Location: "europe", Health: 2},
+			2: {ID: 2, Rank: RankInfantry, Location: "europe", Health: 2, Fortified: true},
+			3: {ID: 3, Rank: RankCavalry, Location: "europe", Health: 5},
+		}},
+	}
+	threeSides := map[string]Player{
+		"alice": twoSides["alice"],
+		"bob":   twoSides["bob"],
+		"carol": {Username: "carol", Units: map[int]Unit{
+			1: {ID: 1, Rank: RankArtillery, Location: "europe", Health: 8, Fortified: true},
+			2: {ID: 2, Rank: RankInfantry, Location: "europe", Health: 2},
+		}},
+	}
+
+	tests := []struct {
+		name    string
+		rules   *Rules
+		players map[string]Player
+		seed    int64
+	}{
+		{"power", power, twoSides, 1},
+		{"power, three sides", power, threeSides, 1},
+		{"dice", &dice, twoSides, 1},
+		{"dice, another seed", &dice, twoSides, 42},
+		{"dice, three sides", &dice, threeSides, 7},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			first, ok := NewWorld(tc.rules, tc.players).War("alice", []Location{"europe"}, tc.seed)
+			if !ok {
+				t.Fatal("no battle was fought")
+			}
+			second, _ := NewWorld(tc.rules, tc.players).War("alice", []Location{"europe"}, tc.seed)
+			battle := first.Battles[0]
+			if len(battle.Casualties) == 0 {
+				t.Fatal("the battle had no casualties to check")
+			}
+			if !slices.Equal(battle.Casualties, second.Battles[0].Casualties) {
+				t.Errorf("the same seed gave %v, then %v", battle.Casualties, second.Battles[0].Casualties)
+			}
+			if err := tc.rules.CheckBattle(battle); err != nil {
+				t.Errorf("CheckBattle rejected the server's result: %v", err)
+			}
+
+			forged := battle
+			forged.Casualties = slices.Clone(battle.Casualties)
+			forged.Casualties[0].Damage++
+			if err := tc.rules.CheckBattle(forged); err == nil {
+				t.Error("CheckBattle accepted altered casualties")
+			}
+		})
+	}
+}
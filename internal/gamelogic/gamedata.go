@@ -3,6 +3,10 @@ package gamelogic
 type Player struct {
 	Username string
 	Units    map[int]Unit
+	// Version counts the authoritative changes applied to the player
+	Version int
+	// NextUnitID only ever grows, so a dead unit's ID is never reused
+	NextUnitID int
 }
 
 type UnitRank string
@@ -17,6 +21,10 @@ type Unit struct {
 	ID       int
 	Rank     UnitRank
 	Location Location
+	// Health drops as the unit takes damage; it dies at zero
+	Health int
+	// Fortified units defend better until they move
+	Fortified bool
 }
 
 type ArmyMove struct {
@@ -25,28 +33,96 @@ type ArmyMove struct {
 	ToLocation Location
 }
 
-type RecognitionOfWar struct {
-	Attacker Player
-	Defender Player
+// WarResolved is every battle one player's move started, one per contested
+// location, in location order.
+type WarResolved struct {
+	Attacker string
+	Battles  []BattleResolved
+}
+
+// BattleResolved is the server's verdict on a battle between everyone with
+// units at one location. All of them apply their losses from it.
+type BattleResolved struct {
+	Location Location
+	// Sides[0] is the player whose move started the battle if they're still
+	// there, the rest are in username order. With the seed, they're enough to replay the battle.
+	Sides []BattleSide
+	Seed  int64
+	// Winner is empty when the battle is a draw
+	Winner     string
+	Casualties []Casualty
+	Losses     []StateDelta
+}
+
+// BattleSide is one player's units in a battle.
+type BattleSide struct {
+	Username string
+	Units    []Unit
+	Power    int
+}
+
+// Casualty is the damage one unit took in a battle, with the unit as it was
+// left afterwards.
+type Casualty struct {
+	Username string
+	Unit     Unit
+	Damage   int
+	Killed   bool
 }
 
 type Location string
 
-func getAllRanks() map[UnitRank]struct{} {
-	return map[UnitRank]struct{}{
-		RankInfantry:  {},
-		RankCavalry:   {},
-		RankArtillery: {},
-	}
-}
-
-func getAllLocations() map[Location]struct{} {
-	return map[Location]struct{}{
-		"americas":   {},
-		"europe":     {},
-		"africa":     {},
-		"asia":       {},
-		"australia":  {},
-		"antarctica": {},
-	}
+// SpawnCommand and MoveCommand ask the server to change a player's units;
+// nothing changes until it has validated them. Token proves the command
+// comes from Username.
+type SpawnCommand struct {
+	Username  string
+	Location  Location
+	Rank      UnitRank
+	RulesHash string
+	Token     string
+}
+
+type MoveCommand struct {
+	Username   string
+	ToLocation Location
+	UnitIDs    []int
+	RulesHash  string
+	Token      string
+}
+
+// RetreatCommand pulls all of a player's units out of a battle that hasn't
+// been fought yet, into a bordering territory.
+type RetreatCommand struct {
+	Username  string
+	From      Location
+	To        Location
+	RulesHash string
+	Token     string
+}
+
+// ReinforceCommand moves units into a battle that hasn't been fought yet.
+type ReinforceCommand struct {
+	Username  string
+	Location  Location
+	UnitIDs   []int
+	RulesHash string
+	Token     string
+}
+
+// FortifyCommand digs in a player's units at a location.
+type FortifyCommand struct {
+	Username  string
+	Location  Location
+	RulesHash string
+	Token     string
+}
+
+// StateDelta is an authoritative change to one player's units, published by
+// the server for the player's view to apply.
+type StateDelta struct {
+	Username string
+	Version  int
+	Units    []Unit
+	Removed  []int
 }
@@ -17,6 +17,15 @@ func PrintClientHelp() {
 	fmt.Println("* spawn <location> <rank>")
 	fmt.Println("    example:")
 	fmt.Println("    spawn europe infantry")
+	fmt.Println("* retreat <from> <to>")
+	fmt.Println("    example:")
+	fmt.Println("    retreat europe africa")
+	fmt.Println("* reinforce <location> <unitID> <unitID> <unitID>...")
+	fmt.Println("    example:")
+	fmt.Println("    reinforce europe 2 3")
+	fmt.Println("* fortify <location>")
+	fmt.Println("    example:")
+	fmt.Println("    fortify europe")
 	fmt.Println("* status")
 	fmt.Println("* spam <n>")
 	fmt.Println("    example:")
@@ -40,8 +49,15 @@ func ClientWelcome() (string, error) {
 
 func PrintServerHelp() {
 	fmt.Println("Possible commands:")
-	fmt.Println("* pause")
-	fmt.Println("* resume")
+	fmt.Println("* pause [duration]")
+	fmt.Println("    example:")
+	fmt.Println("    pause 5m")
+	fmt.Println("* resume [duration]")
+	fmt.Println("    example:")
+	fmt.Println("    resume 30s")
+	fmt.Println("* leader")
+	fmt.Println("* shards")
+	fmt.Println("* offenders")
 	fmt.Println("* quit")
 	fmt.Println("* help")
 }
@@ -58,6 +74,31 @@ func GetInput() []string {
 	return strings.Fields(line)
 }
 
+// ReadInputs reads commands on its own goroutine so a REPL can wait on
+// input and signals at once. Call next to prompt for each command; the
+// channel is closed when stdin is.
+func ReadInputs() (inputs <-chan []string, next func()) {
+	ch := make(chan []string)
+	ready := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		for range ready {
+			words := GetInput()
+			if words == nil {
+				return
+			}
+			ch <- words
+		}
+	}()
+	next = func() {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}
+	return ch, next
+}
+
 func GetMaliciousLog() string {
 	possibleLogs := []string{
 		"Never interrupt your enemy when he is making a mistake.",
@@ -87,6 +128,10 @@ func (gs *GameState) CommandStatus() {
 	p := gs.GetPlayerSnap()
 	fmt.Printf("You are %s, and you have %d units.\n", p.Username, len(p.Units))
 	for _, unit := range p.Units {
-		fmt.Printf("* %v: %v, %v\n", unit.ID, unit.Location, unit.Rank)
+		fortified := ""
+		if unit.Fortified {
+			fortified = ", fortified"
+		}
+		fmt.Printf("* %v: %v, %v (%v health%s)\n", unit.ID, unit.Location, unit.Rank, unit.Health, fortified)
 	}
 }
@@ -0,0 +1,78 @@
+package gamelogic
+
+import (
+	"fmt"
+)
+
+// Map is the board: territories and the borders units cross between them.
+type Map struct {
+	Territories []Location    `json:"territories"`
+	Edges       [][2]Location `json:"edges"`
+	adjacent    map[Location][]Location
+}
+
+// index checks that edges join known territories and builds the adjacency
+// lists Path walks.
+func (m *Map) index() error {
+	if len(m.Territories) == 0 {
+		return fmt.Errorf("no territories")
+	}
+
+	m.adjacent = map[Location][]Location{}
+	for _, t := range m.Territories {
+		if _, ok := m.adjacent[t]; ok {
+			return fmt.Errorf("territory %s is listed twice", t)
+		}
+		m.adjacent[t] = []Location{}
+	}
+	for _, edge := range m.Edges {
+		for _, end := range edge {
+			if !m.HasTerritory(end) {
+				return fmt.Errorf("edge %s-%s: unknown territory %s", edge[0], edge[1], end)
+			}
+		}
+		m.adjacent[edge[0]] = append(m.adjacent[edge[0]], edge[1])
+		m.adjacent[edge[1]] = append(m.adjacent[edge[1]], edge[0])
+	}
+	return nil
+}
+
+func (m *Map) HasTerritory(loc Location) bool {
+	_, ok := m.adjacent[loc]
+	return ok
+}
+
+// Borders reports whether a and b are joined by an edge.
+func (m *Map) Borders(a, b Location) bool {
+	for _, next := range m.adjacent[a] {
+		if next == b {
+			return true
+		}
+	}
+	return false
+}
+
+// Path is a shortest route from one territory to another, both ends
+// included, or nil if to can't be reached.
+func (m *Map) Path(from, to Location) []Location {
+	prev := map[Location]Location{from: from}
+	queue := []Location{from}
+	for len(queue) > 0 {
+		loc := queue[0]
+		queue = queue[1:]
+		if loc == to {
+			path := []Location{to}
+			for path[0] != from {
+				path = append([]Location{prev[path[0]]}, path...)
+			}
+			return path
+		}
+		for _, next := range m.adjacent[loc] {
+			if _, seen := prev[next]; !seen {
+				prev[next] = loc
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package gamelogic
+
+import "testing"
+
+func TestPath(t *testing.T) {
+	m := DefaultRules().Map
+	tests := []struct {
+		from, to Location
+		// borders crossed, or -1 if to can't be reached
+		hops int
+	}{
+		{"europe", "europe", 0},
+		{"americas", "europe", 1},
+		{"europe", "americas", 1},
+		{"europe", "australia", 2},
+		{"africa", "australia", 2},
+		{"europe", "atlantis", -1},
+		{"atlantis", "europe", -1},
+	}
+	for _, tc := range tests {
+		path := m.Path(tc.from, tc.to)
+		if tc.hops < 0 {
+			if path != nil {
+				t.Errorf("Path(%s, %s) = %v, want nil", tc.from, tc.to, path)
+			}
+			continue
+		}
+		if len(path)-1 != tc.hops || path[0] != tc.from || path[len(path)-1] != tc.to {
+			t.Errorf("Path(%s, %s) = %v, want %d border(s)", tc.from, tc.to, path, tc.hops)
+			continue
+		}
+		for i := 1; i < len(path); i++ {
+			if !m.Borders(path[i-1], path[i]) {
+				t.Errorf("Path(%s, %s) = %v crosses from %s to %s, which don't border", tc.from, tc.to, path, path[i-1], path[i])
+			}
+		}
+	}
+}
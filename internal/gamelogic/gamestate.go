@@ -2,12 +2,16 @@ package gamelogic
 
 import (
 	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
 type GameState struct {
 	Player Player
 	Paused bool
 	mu     *sync.RWMutex
+	// the pause or resume Paused comes from
+	playing routing.PlayingState
 }
 
 func NewGameState(username string) *GameState {
@@ -21,16 +25,17 @@ func NewGameState(username string) *GameState {
 	}
 }
 
-func (gs *GameState) resumeGame() {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	gs.Paused = false
-}
-
-func (gs *GameState) pauseGame() {
+// setPlayingState pauses or resumes the game unless ps was issued before
+// the last pause or resume.
+func (gs *GameState) setPlayingState(ps routing.PlayingState) bool {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
-	gs.Paused = true
+	if !ps.Supersedes(gs.playing) {
+		return false
+	}
+	gs.playing = ps
+	gs.Paused = ps.IsPaused
+	return true
 }
 
 func (gs *GameState) isPaused() bool {
@@ -39,58 +44,80 @@ func (gs *GameState) isPaused() bool {
 	return gs.Paused
 }
 
-func (gs *GameState) addUnit(u Unit) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
+func (gs *GameState) GetUsername() string {
+	return gs.Player.Username
 }
 
-func (gs *GameState) removeUnitsInLocation(loc Location) {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
+func (gs *GameState) GetPlayerSnap() Player {
+	gs.mu.RLock()
+	defer gs.mu.RUnlock()
+	Units := map[int]Unit{}
 	for k, v := range gs.Player.Units {
-		if v.Location == loc {
-			delete(gs.Player.Units, k)
-		}
+		Units[k] = v
+	}
+	return Player{
+		Username:   gs.Player.Username,
+		Units:      Units,
+		Version:    gs.Player.Version,
+		NextUnitID: gs.Player.NextUnitID,
 	}
 }
 
-func (gs *GameState) UpdateUnit(u Unit) {
+// RestorePlayer replaces the player's units with a snapshot from the server,
+// unless the view has already seen a newer version.
+func (gs *GameState) RestorePlayer(p Player) {
 	gs.mu.Lock()
 	defer gs.mu.Unlock()
-	gs.Player.Units[u.ID] = u
+	if p.Version < gs.Player.Version {
+		return
+	}
+	gs.Player = copyPlayer(p)
 }
 
-func (gs *GameState) GetUsername() string {
-	return gs.Player.Username
-}
+type DeltaResult int
 
-func (gs *GameState) getUnitsSnap() []Unit {
-	gs.mu.RLock()
-	defer gs.mu.RUnlock()
-	Units := []Unit{}
-	for _, v := range gs.Player.Units {
-		Units = append(Units, v)
+const (
+	DeltaApplied DeltaResult = iota
+	// DeltaIgnored: about another player, or already applied
+	DeltaIgnored
+	// DeltaGap: an earlier delta hasn't arrived yet, so the view must be
+	// fetched from the server again
+	DeltaGap
+)
+
+// ApplyDelta updates the view with a change from the server. Deltas only
+// patch the units they name, so they apply strictly in version order; the
+// same delta can arrive both in a command's reply and on the player's state
+// queue, and the two can overtake each other.
+func (gs *GameState) ApplyDelta(d StateDelta) DeltaResult {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if d.Username != gs.Player.Username || d.Version <= gs.Player.Version {
+		return DeltaIgnored
 	}
-	return Units
+	if d.Version != gs.Player.Version+1 {
+		return DeltaGap
+	}
+	applyDelta(&gs.Player, d)
+	return DeltaApplied
 }
 
-func (gs *GameState) GetUnit(id int) (Unit, bool) {
-	gs.mu.RLock()
-	defer gs.mu.RUnlock()
-	u, ok := gs.Player.Units[id]
-	return u, ok
+// SyncPlayer replaces the player's units with the server's, as returned by
+// fetch.
+func (gs *GameState) SyncPlayer(fetch func() (Player, error)) error {
+	player, err := fetch()
+	if err != nil {
+		return err
+	}
+	gs.RestorePlayer(player)
+	return nil
 }
 
-func (gs *GameState) GetPlayerSnap() Player {
-	gs.mu.RLock()
-	defer gs.mu.RUnlock()
-	Units := map[int]Unit{}
-	for k, v := range gs.Player.Units {
-		Units[k] = v
-	}
-	return Player{
-		Username: gs.Player.Username,
-		Units:    Units,
+// ApplyDeltaOrSync applies a delta from the server, fetching the player's
+// units again if an earlier delta hasn't arrived yet.
+func (gs *GameState) ApplyDeltaOrSync(d StateDelta, fetch func() (Player, error)) error {
+	if gs.ApplyDelta(d) != DeltaGap {
+		return nil
 	}
+	return gs.SyncPlayer(fetch)
 }
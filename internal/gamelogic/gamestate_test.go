@@ -0,0 +1,80 @@
+package gamelogic
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestApplyDelta(t *testing.T) {
+	tests := []struct {
+		name    string
+		delta   StateDelta
+		want    DeltaResult
+		version int
+	}{
+		{"next version", StateDelta{Username: "alice", Version: 4, Units: []Unit{{ID: 2}}}, DeltaApplied, 4},
+		{"already applied", StateDelta{Username: "alice", Version: 3, Units: []Unit{{ID: 2}}}, DeltaIgnored, 3},
+		{"older version", StateDelta{Username: "alice", Version: 1, Removed: []int{1}}, DeltaIgnored, 3},
+		{"another player", StateDelta{Username: "bob", Version: 4, Units: []Unit{{ID: 2}}}, DeltaIgnored, 3},
+		{"a version missing", StateDelta{Username: "alice", Version: 5, Units: []Unit{{ID: 2}}}, DeltaGap, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gs := NewGameState("alice")
+			gs.RestorePlayer(Player{Username: "alice", Version: 3, Units: map[int]Unit{1: {ID: 1}}})
+
+			if got := gs.ApplyDelta(tc.delta); got != tc.want {
+				t.Errorf("ApplyDelta = %v, want %v", got, tc.want)
+			}
+			p := gs.GetPlayerSnap()
+			if p.Version != tc.version {
+				t.Errorf("version %d, want %d", p.Version, tc.version)
+			}
+			// Only an applied delta may touch the units
+			wantUnits := 1
+			if tc.want == DeltaApplied {
+				wantUnits = 2
+			}
+			if len(p.Units) != wantUnits {
+				t.Errorf("got %d unit(s), want %d", len(p.Units), wantUnits)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaOrSync(t *testing.T) {
+	server := Player{Username: "alice", Version: 5, Units: map[int]Unit{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}}}
+	tests := []struct {
+		name     string
+		delta    StateDelta
+		fetchErr error
+		fetched  bool
+		version  int
+	}{
+		{"in order", StateDelta{Username: "alice", Version: 4}, nil, false, 4},
+		{"already applied", StateDelta{Username: "alice", Version: 3}, nil, false, 3},
+		{"after a gap", StateDelta{Username: "alice", Version: 5}, nil, true, 5},
+		{"after a gap, server unreachable", StateDelta{Username: "alice", Version: 5}, errors.New("timed out"), true, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gs := NewGameState("alice")
+			gs.RestorePlayer(Player{Username: "alice", Version: 3, Units: map[int]Unit{1: {ID: 1}}})
+
+			fetched := false
+			err := gs.ApplyDeltaOrSync(tc.delta, func() (Player, error) {
+				fetched = true
+				return server, tc.fetchErr
+			})
+			if err != tc.fetchErr {
+				t.Errorf("got error %v, want %v", err, tc.fetchErr)
+			}
+			if fetched != tc.fetched {
+				t.Errorf("fetched %v, want %v", fetched, tc.fetched)
+			}
+			if got := gs.GetPlayerSnap().Version; got != tc.version {
+				t.Errorf("version %d, want %d", got, tc.version)
+			}
+		})
+	}
+}
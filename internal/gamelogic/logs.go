@@ -28,5 +28,9 @@ func WriteLog(gamelog routing.GameLog) error {
 	if err != nil {
 		return fmt.Errorf("could not write to logs file: %v", err)
 	}
+	// Make sure an acked log survives the server exiting right after
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not flush logs file: %v", err)
+	}
 	return nil
 }
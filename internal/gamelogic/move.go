@@ -3,6 +3,7 @@ package gamelogic
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 )
 
@@ -29,64 +30,92 @@ func (gs *GameState) HandleMove(move ArmyMove) MoveOutcome {
 		return MoveOutcomeSamePlayer
 	}
 
-	overlappingLocation := getOverlappingLocation(player, move.Player)
-	if overlappingLocation != "" {
-		fmt.Printf("You have units in %s! You are at war with %s!\n", overlappingLocation, move.Player.Username)
+	overlappingLocations := getOverlappingLocations(player, move.Player)
+	if len(overlappingLocations) > 0 {
+		for _, loc := range overlappingLocations {
+			fmt.Printf("You have units in %s! You are at war with %s!\n", loc, move.Player.Username)
+		}
+		fmt.Println("You can retreat, reinforce or fortify until the fighting starts.")
 		return MoveOutcomeMakeWar
 	}
 	fmt.Printf("You are safe from %s's units.\n", move.Player.Username)
 	return MoveOutComeSafe
 }
 
-func getOverlappingLocation(p1 Player, p2 Player) Location {
+// getOverlappingLocations lists every location both players have units in,
+// sorted.
+func getOverlappingLocations(p1 Player, p2 Player) []Location {
+	found := map[Location]bool{}
 	for _, u1 := range p1.Units {
 		for _, u2 := range p2.Units {
 			if u1.Location == u2.Location {
-				return u1.Location
+				found[u1.Location] = true
 			}
 		}
 	}
-	return ""
+	locations := []Location{}
+	for loc := range found {
+		locations = append(locations, loc)
+	}
+	slices.Sort(locations)
+	return locations
 }
 
-func (gs *GameState) CommandMove(words []string) (ArmyMove, error) {
-	if gs.isPaused() {
-		return ArmyMove{}, errors.New("the game is paused, you can not move units")
-	}
+// ParseMove turns "move <location> <unitID>..." into a command for the
+// server.
+func ParseMove(username string, words []string) (MoveCommand, error) {
 	if len(words) < 3 {
-		return ArmyMove{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
-	}
-	newLocation := Location(words[1])
-	locations := getAllLocations()
-	if _, ok := locations[newLocation]; !ok {
-		return ArmyMove{}, fmt.Errorf("error: %s is not a valid location", newLocation)
+		return MoveCommand{}, errors.New("usage: move <location> <unitID> <unitID> <unitID> etc")
 	}
 	unitIDs := []int{}
 	for _, word := range words[2:] {
 		id := word
 		unitID, err := strconv.Atoi(id)
 		if err != nil {
-			return ArmyMove{}, fmt.Errorf("error: %s is not a valid unit ID", id)
+			return MoveCommand{}, fmt.Errorf("error: %s is not a valid unit ID", id)
 		}
 		unitIDs = append(unitIDs, unitID)
 	}
+	return MoveCommand{
+		Username:   username,
+		ToLocation: Location(words[1]),
+		UnitIDs:    unitIDs,
+	}, nil
+}
 
+// Move validates cmd against the player's units and returns the move to
+// announce along with the delta that makes it.
+func (w *World) Move(cmd MoveCommand) (ArmyMove, StateDelta, error) {
+	if !w.rules.Map.HasTerritory(cmd.ToLocation) {
+		return ArmyMove{}, StateDelta{}, fmt.Errorf("error: %s is not a valid location", cmd.ToLocation)
+	}
+
+	player := w.Player(cmd.Username)
 	newUnits := []Unit{}
-	for _, unitID := range unitIDs {
-		unit, ok := gs.GetUnit(unitID)
+	for _, unitID := range cmd.UnitIDs {
+		unit, ok := player.Units[unitID]
 		if !ok {
-			return ArmyMove{}, fmt.Errorf("error: unit with ID %v not found", unitID)
+			return ArmyMove{}, StateDelta{}, fmt.Errorf("error: unit with ID %v not found", unitID)
 		}
-		unit.Location = newLocation
-		gs.UpdateUnit(unit)
+		if err := w.rules.CheckMove(unit, cmd.ToLocation); err != nil {
+			return ArmyMove{}, StateDelta{}, err
+		}
+		unit.Location = cmd.ToLocation
+		unit.Fortified = false
+		player.Units[unitID] = unit
 		newUnits = append(newUnits, unit)
 	}
+	player.Version++
 
 	mv := ArmyMove{
-		ToLocation: newLocation,
+		ToLocation: cmd.ToLocation,
 		Units:      newUnits,
-		Player:     gs.GetPlayerSnap(),
+		Player:     player,
+	}
+	delta := StateDelta{
+		Username: cmd.Username,
+		Version:  player.Version,
+		Units:    newUnits,
 	}
-	fmt.Printf("Moved %v units to %s\n", len(mv.Units), mv.ToLocation)
-	return mv, nil
+	return mv, delta, nil
 }
@@ -6,14 +6,20 @@ import (
 	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
 )
 
-func (gs *GameState) HandlePause(ps routing.PlayingState) {
+// HandlePause ignores a pause or resume issued before the last one it saw,
+// such as a scheduled resume that has since been overridden, and reports
+// whether it took ps.
+func (gs *GameState) HandlePause(ps routing.PlayingState) bool {
 	defer fmt.Println("------------------------")
 	fmt.Println()
+	if !gs.setPlayingState(ps) {
+		fmt.Println("==== Cancelled Resume Ignored ====")
+		return false
+	}
 	if ps.IsPaused {
 		fmt.Println("==== Pause Detected ====")
-		gs.pauseGame()
 	} else {
 		fmt.Println("==== Resume Detected ====")
-		gs.resumeGame()
 	}
+	return true
 }
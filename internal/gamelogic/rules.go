@@ -0,0 +1,183 @@
+package gamelogic
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// RulesVersion is the ruleset format this build understands.
+const RulesVersion = 1
+
+//go:embed rules/default.json
+var defaultRules []byte
+
+// Rules are the game's data: which ranks exist, how strong they are, how far
+// they move, and the map they move on.
+type Rules struct {
+	Version int `json:"version"`
+	// Combat is CombatPower (the default) or CombatDice
+	Combat string `json:"combat"`
+	// FortifyBonus is taken off the damage fortified units take in
+	// CombatPower, and added to their defense rolls in CombatDice
+	FortifyBonus int                    `json:"fortify_bonus"`
+	Ranks        map[UnitRank]RankRules `json:"ranks"`
+	Map          Map                    `json:"map"`
+	hash         string
+}
+
+type RankRules struct {
+	Power int `json:"power"`
+	// Range is how many borders a unit may cross in one move
+	Range  int `json:"range"`
+	Health int `json:"health"`
+	// Added to the unit's dice rolls in CombatDice
+	Attack  int `json:"attack"`
+	Defense int `json:"defense"`
+}
+
+func DefaultRules() *Rules {
+	r, err := ParseRules(defaultRules)
+	if err != nil {
+		panic(fmt.Sprintf("built-in rules are invalid: %v", err))
+	}
+	return r
+}
+
+// LoadActiveRules reads the rules from the file named by PERIL_RULES, or
+// returns the built-in rules if it isn't set.
+func LoadActiveRules() (*Rules, error) {
+	path := os.Getenv("PERIL_RULES")
+	if path == "" {
+		return DefaultRules(), nil
+	}
+	return LoadRules(path)
+}
+
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read rules: %v", err)
+	}
+	r, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("rules %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// ParseRules decodes and validates a ruleset.
+func ParseRules(data []byte) (*Rules, error) {
+	r := &Rules{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	if r.Version != RulesVersion {
+		return nil, fmt.Errorf("version %d is not supported, expected %d", r.Version, RulesVersion)
+	}
+	switch r.Combat {
+	case "":
+		r.Combat = CombatPower
+	case CombatPower, CombatDice:
+	default:
+		return nil, fmt.Errorf("unknown combat model %q", r.Combat)
+	}
+	if r.FortifyBonus < 0 {
+		return nil, fmt.Errorf("fortify bonus can't be negative")
+	}
+	if len(r.Ranks) == 0 {
+		return nil, fmt.Errorf("no ranks")
+	}
+	for rank, rr := range r.Ranks {
+		if rr.Power < 1 {
+			return nil, fmt.Errorf("%s needs a power of at least 1", rank)
+		}
+		if rr.Range < 1 {
+			return nil, fmt.Errorf("%s needs a range of at least 1", rank)
+		}
+		if rr.Health < 1 {
+			return nil, fmt.Errorf("%s needs a health of at least 1", rank)
+		}
+		if rr.Attack < 0 || rr.Defense < 0 {
+			return nil, fmt.Errorf("%s can't have a negative attack or defense", rank)
+		}
+	}
+	if err := r.Map.index(); err != nil {
+		return nil, fmt.Errorf("map: %v", err)
+	}
+
+	// Hash the re-encoded rules so formatting doesn't matter
+	canonical, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(canonical)
+	r.hash = hex.EncodeToString(sum[:])
+	return r, nil
+}
+
+// Hash identifies the ruleset; players and the server must agree on it.
+func (r *Rules) Hash() string {
+	return r.hash
+}
+
+func (r *Rules) HasRank(rank UnitRank) bool {
+	_, ok := r.Ranks[rank]
+	return ok
+}
+
+// CheckMove reports whether unit can get to `to` within its rank's range.
+func (r *Rules) CheckMove(unit Unit, to Location) error {
+	path := r.Map.Path(unit.Location, to)
+	if path == nil {
+		return fmt.Errorf("error: unit %v can't reach %s from %s", unit.ID, to, unit.Location)
+	}
+	maxMoves := r.Ranks[unit.Rank].Range
+	if moves := len(path) - 1; moves > maxMoves {
+		return fmt.Errorf("error: unit %v (%s) can move %d territory(ies) at a time, %s is %d away from %s",
+			unit.ID, unit.Rank, maxMoves, to, moves, unit.Location)
+	}
+	return nil
+}
+
+// fortification is the bonus unit gets for being fortified.
+func (r *Rules) fortification(unit Unit) int {
+	if unit.Fortified {
+		return r.FortifyBonus
+	}
+	return 0
+}
+
+func (r *Rules) PowerLevel(units []Unit) int {
+	power := 0
+	for _, unit := range units {
+		power += r.Ranks[unit.Rank].Power
+	}
+	return power
+}
+
+// ShortHash is the start of Hash, for showing to players.
+func (r *Rules) ShortHash() string {
+	return shortHash(r.hash)
+}
+
+// CheckHash rejects players whose rules differ from the server's.
+func (r *Rules) CheckHash(hash string) error {
+	if hash != r.hash {
+		return fmt.Errorf("your ruleset (%s) doesn't match the server's (%s)", shortHash(hash), shortHash(r.hash))
+	}
+	return nil
+}
+
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	if hash == "" {
+		return "none"
+	}
+	return hash
+}
@@ -0,0 +1,87 @@
+package gamelogic
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCheckMove(t *testing.T) {
+	rules := DefaultRules()
+	tests := []struct {
+		name string
+		unit Unit
+		to   Location
+		ok   bool
+	}{
+		{"infantry to a neighbour", Unit{Rank: RankInfantry, Location: "europe"}, "asia", true},
+		{"infantry two borders away", Unit{Rank: RankInfantry, Location: "europe"}, "australia", false},
+		{"cavalry two borders away", Unit{Rank: RankCavalry, Location: "europe"}, "australia", true},
+		{"staying put", Unit{Rank: RankArtillery, Location: "europe"}, "europe", true},
+		{"off the map", Unit{Rank: RankCavalry, Location: "europe"}, "atlantis", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := rules.CheckMove(tc.unit, tc.to)
+			if (err == nil) != tc.ok {
+				t.Errorf("CheckMove(%s in %s, %s) = %v, want ok %v", tc.unit.Rank, tc.unit.Location, tc.to, err, tc.ok)
+			}
+		})
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(r map[string]any)
+		ok     bool
+	}{
+		{"built-in rules", func(map[string]any) {}, true},
+		{"combat defaults to power", func(r map[string]any) { delete(r, "combat") }, true},
+		{"unsupported version", func(r map[string]any) { r["version"] = RulesVersion + 1 }, false},
+		{"unknown combat model", func(r map[string]any) { r["combat"] = "chess" }, false},
+		{"negative fortify bonus", func(r map[string]any) { r["fortify_bonus"] = -1 }, false},
+		{"no ranks", func(r map[string]any) { r["ranks"] = map[string]any{} }, false},
+		{"zero power", func(r map[string]any) { rank(r, "infantry")["power"] = 0 }, false},
+		{"zero range", func(r map[string]any) { rank(r, "infantry")["range"] = 0 }, false},
+		{"zero health", func(r map[string]any) { rank(r, "infantry")["health"] = 0 }, false},
+		{"negative defense", func(r map[string]any) { rank(r, "infantry")["defense"] = -1 }, false},
+		{"no territories", func(r map[string]any) { r["map"] = map[string]any{} }, false},
+		{"territory listed twice", func(r map[string]any) {
+			m := r["map"].(map[string]any)
+			m["territories"] = append(m["territories"].([]any), "europe")
+		}, false},
+		{"edge to an unknown territory", func(r map[string]any) {
+			m := r["map"].(map[string]any)
+			m["edges"] = append(m["edges"].([]any), []any{"europe", "atlantis"})
+		}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := map[string]any{}
+			if err := json.Unmarshal(defaultRules, &r); err != nil {
+				t.Fatal(err)
+			}
+			tc.change(r)
+			data, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := ParseRules(data)
+			if (err == nil) != tc.ok {
+				t.Fatalf("ParseRules = %v, want ok %v", err, tc.ok)
+			}
+			if err == nil && rules.Combat == "" {
+				t.Error("no combat model was set")
+			}
+		})
+	}
+
+	if _, err := ParseRules([]byte("{")); err == nil {
+		t.Error("ParseRules accepted malformed JSON")
+	}
+}
+
+func rank(r map[string]any, name string) map[string]any {
+	return r["ranks"].(map[string]any)[name].(map[string]any)
+}
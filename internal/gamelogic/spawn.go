@@ -5,30 +5,43 @@ import (
 	"fmt"
 )
 
-func (gs *GameState) CommandSpawn(words []string) error {
+// ParseSpawn turns "spawn <location> <rank>" into a command for the server.
+func ParseSpawn(username string, words []string) (SpawnCommand, error) {
 	if len(words) < 3 {
-		return errors.New("usage: spawn <location> <rank>")
+		return SpawnCommand{}, errors.New("usage: spawn <location> <rank>")
 	}
+	return SpawnCommand{
+		Username: username,
+		Location: Location(words[1]),
+		Rank:     UnitRank(words[2]),
+	}, nil
+}
 
-	locationName := words[1]
-	locations := getAllLocations()
-	if _, ok := locations[Location(locationName)]; !ok {
-		return fmt.Errorf("error: %s is not a valid location", locationName)
+// Spawn validates cmd and returns the delta adding the new unit.
+func (w *World) Spawn(cmd SpawnCommand) (StateDelta, error) {
+	if !w.rules.Map.HasTerritory(cmd.Location) {
+		return StateDelta{}, fmt.Errorf("error: %s is not a valid location", cmd.Location)
 	}
 
-	rank := words[2]
-	units := getAllRanks()
-	if _, ok := units[UnitRank(rank)]; !ok {
-		return fmt.Errorf("error: %s is not a valid unit", rank)
+	if !w.rules.HasRank(cmd.Rank) {
+		return StateDelta{}, fmt.Errorf("error: %s is not a valid unit", cmd.Rank)
 	}
 
-	id := len(gs.getUnitsSnap()) + 1
-	gs.addUnit(Unit{
-		ID:       id,
-		Rank:     UnitRank(rank),
-		Location: Location(locationName),
-	})
+	player := w.Player(cmd.Username)
+	id := player.nextUnitID()
+	return StateDelta{
+		Username: cmd.Username,
+		Version:  player.Version + 1,
+		Units: []Unit{{
+			ID:       id,
+			Rank:     cmd.Rank,
+			Location: cmd.Location,
+			Health:   w.rules.Ranks[cmd.Rank].Health,
+		}},
+	}, nil
+}
 
-	fmt.Printf("Spawned a(n) %s in %s with id %v\n", rank, locationName, id)
-	return nil
+// nextUnitID allocates p's next unit ID.
+func (p Player) nextUnitID() int {
+	return max(p.NextUnitID, 1)
 }
@@ -0,0 +1,47 @@
+package gamelogic
+
+import "testing"
+
+func TestSpawnNeverReusesIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		spawns int
+		killed []int
+		reload bool
+		want   int
+	}{
+		{"first unit", 0, nil, false, 1},
+		{"after the newest is killed", 2, []int{2}, false, 3},
+		{"after an older one is killed", 3, []int{2}, false, 4},
+		{"after all are killed", 3, []int{1, 2, 3}, false, 4},
+		{"after all are killed and the world is reloaded", 3, []int{1, 2, 3}, true, 4},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rules := DefaultRules()
+			w := NewWorld(rules, nil)
+			cmd := SpawnCommand{Username: "alice", Location: "europe", Rank: RankInfantry}
+			spawn := func() int {
+				d, err := w.Spawn(cmd)
+				if err != nil {
+					t.Fatalf("spawning: %v", err)
+				}
+				w.Apply(d)
+				return d.Units[0].ID
+			}
+
+			for range tc.spawns {
+				spawn()
+			}
+			if len(tc.killed) > 0 {
+				w.Apply(StateDelta{Username: "alice", Version: w.Player("alice").Version + 1, Removed: tc.killed})
+			}
+			if tc.reload {
+				w = NewWorld(rules, w.Snapshot())
+			}
+			if got := spawn(); got != tc.want {
+				t.Errorf("spawned unit %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
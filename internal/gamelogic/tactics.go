@@ -0,0 +1,106 @@
+package gamelogic
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// ParseRetreat turns "retreat <from> <to>" into a command for the server.
+func ParseRetreat(username string, words []string) (RetreatCommand, error) {
+	if len(words) < 3 {
+		return RetreatCommand{}, errors.New("usage: retreat <from> <to>")
+	}
+	return RetreatCommand{
+		Username: username,
+		From:     Location(words[1]),
+		To:       Location(words[2]),
+	}, nil
+}
+
+// ParseReinforce turns "reinforce <location> <unitID>..." into a command
+// for the server.
+func ParseReinforce(username string, words []string) (ReinforceCommand, error) {
+	if len(words) < 3 {
+		return ReinforceCommand{}, errors.New("usage: reinforce <location> <unitID> <unitID> <unitID> etc")
+	}
+	move, err := ParseMove(username, words)
+	if err != nil {
+		return ReinforceCommand{}, err
+	}
+	return ReinforceCommand{
+		Username: username,
+		Location: move.ToLocation,
+		UnitIDs:  move.UnitIDs,
+	}, nil
+}
+
+// ParseFortify turns "fortify <location>" into a command for the server.
+func ParseFortify(username string, words []string) (FortifyCommand, error) {
+	if len(words) < 2 {
+		return FortifyCommand{}, errors.New("usage: fortify <location>")
+	}
+	return FortifyCommand{
+		Username: username,
+		Location: Location(words[1]),
+	}, nil
+}
+
+// Retreat validates cmd and moves all the player's units out of the battle
+// at From, which must not have been fought yet, to a bordering territory.
+func (w *World) Retreat(cmd RetreatCommand) (ArmyMove, StateDelta, error) {
+	if !slices.Contains(w.Contested(cmd.Username), cmd.From) {
+		return ArmyMove{}, StateDelta{}, fmt.Errorf("error: you aren't in a battle in %s", cmd.From)
+	}
+	if !w.rules.Map.Borders(cmd.From, cmd.To) {
+		return ArmyMove{}, StateDelta{}, fmt.Errorf("error: %s doesn't border %s", cmd.To, cmd.From)
+	}
+
+	move := MoveCommand{
+		Username:   cmd.Username,
+		ToLocation: cmd.To,
+	}
+	for _, unit := range unitsIn(w.Player(cmd.Username), cmd.From) {
+		move.UnitIDs = append(move.UnitIDs, unit.ID)
+	}
+	return w.Move(move)
+}
+
+// Reinforce validates cmd and moves units into the battle at Location,
+// which must not have been fought yet.
+func (w *World) Reinforce(cmd ReinforceCommand) (ArmyMove, StateDelta, error) {
+	if !slices.Contains(w.Battles(), cmd.Location) {
+		return ArmyMove{}, StateDelta{}, fmt.Errorf("error: there is no battle in %s to reinforce", cmd.Location)
+	}
+	return w.Move(MoveCommand{
+		Username:   cmd.Username,
+		ToLocation: cmd.Location,
+		UnitIDs:    cmd.UnitIDs,
+	})
+}
+
+// Fortify validates cmd and returns the delta fortifying the player's units
+// at Location.
+func (w *World) Fortify(cmd FortifyCommand) (StateDelta, error) {
+	player := w.Player(cmd.Username)
+	units := unitsIn(player, cmd.Location)
+	if len(units) == 0 {
+		return StateDelta{}, fmt.Errorf("error: you have no units in %s", cmd.Location)
+	}
+
+	delta := StateDelta{
+		Username: cmd.Username,
+		Version:  player.Version + 1,
+		Units:    []Unit{},
+	}
+	for _, unit := range units {
+		if !unit.Fortified {
+			unit.Fortified = true
+			delta.Units = append(delta.Units, unit)
+		}
+	}
+	if len(delta.Units) == 0 {
+		return StateDelta{}, fmt.Errorf("error: your units in %s are already fortified", cmd.Location)
+	}
+	return delta, nil
+}
@@ -2,104 +2,382 @@ package gamelogic
 
 import (
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 )
 
 type WarOutcome int
 
 const (
 	WarOutcomeNotInvolved WarOutcome = iota
-	WarOutcomeNoUnits
 	WarOutcomeYouWon
 	WarOutcomeOpponentWon
 	WarOutcomeDraw
 )
 
-func (gs *GameState) HandleWar(rw RecognitionOfWar) (outcome WarOutcome, winner string, loser string) {
-	defer fmt.Println("------------------------")
-	fmt.Println()
-	fmt.Println("==== War Declared ====")
-	fmt.Printf("%s has declared war on %s!\n", rw.Attacker.Username, rw.Defender.Username)
+// War fights out the battles attacker started at locs, in location order,
+// each seeing the losses of the ones before it; locations nobody is
+// contesting any more are skipped. The nth battle is fought with seed+n. It
+// reports false if there was nothing left to fight.
+func (w *World) War(attacker string, locs []Location, seed int64) (WarResolved, bool) {
+	players := w.Snapshot()
+	war := WarResolved{
+		Attacker: attacker,
+		Battles:  []BattleResolved{},
+	}
+	sorted := slices.Clone(locs)
+	slices.Sort(sorted)
+	for _, loc := range slices.Compact(sorted) {
+		battle, ok := battleAt(w.rules, players, attacker, loc, seed+int64(len(war.Battles)))
+		if !ok {
+			continue
+		}
+		for _, loss := range battle.Losses {
+			applyToPlayers(players, loss)
+		}
+		war.Battles = append(war.Battles, battle)
+	}
+	return war, len(war.Battles) > 0
+}
+
+// Contested lists the locations username shares with anyone, sorted.
+func (w *World) Contested(username string) []Location {
+	return contestedLocations(w.Snapshot(), username)
+}
 
-	player := gs.GetPlayerSnap()
+// ContestedAfter lists the locations d's player would share with anyone
+// after d, sorted.
+func (w *World) ContestedAfter(d StateDelta) []Location {
+	return contestedLocations(w.Preview(d), d.Username)
+}
 
-	if player.Username == rw.Defender.Username {
-		fmt.Printf("%s, you published the war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+// Battles lists every location where two or more players have units,
+// sorted.
+func (w *World) Battles() []Location {
+	players := w.Snapshot()
+	found := map[Location]bool{}
+	for username := range players {
+		for _, loc := range contestedLocations(players, username) {
+			found[loc] = true
+		}
 	}
+	locations := []Location{}
+	for loc := range found {
+		locations = append(locations, loc)
+	}
+	slices.Sort(locations)
+	return locations
+}
 
-	if player.Username != rw.Attacker.Username {
-		fmt.Printf("%s, you are not involved in this war.\n", player.Username)
-		return WarOutcomeNotInvolved, "", ""
+// contestedLocations lists where username has units alongside anyone else,
+// sorted.
+func contestedLocations(players map[string]Player, username string) []Location {
+	found := map[Location]bool{}
+	for name, p := range players {
+		if name != username {
+			for _, loc := range getOverlappingLocations(players[username], p) {
+				found[loc] = true
+			}
+		}
 	}
+	locations := []Location{}
+	for loc := range found {
+		locations = append(locations, loc)
+	}
+	slices.Sort(locations)
+	return locations
+}
 
-	overlappingLocation := getOverlappingLocation(rw.Attacker, rw.Defender)
-	if overlappingLocation == "" {
-		fmt.Printf("Error! No units are in the same location. No war will be fought.\n")
-		return WarOutcomeNoUnits, "", ""
+// battleAt fights out the battle attacker started at loc, with everyone who
+// has units there. If attacker has left, the others still fight it out.
+func battleAt(rules *Rules, players map[string]Player, attacker string, loc Location, seed int64) (BattleResolved, bool) {
+	// The player who moved in goes first, then the others by username
+	names := []string{}
+	for name, p := range players {
+		if name != attacker && len(unitsIn(p, loc)) > 0 {
+			names = append(names, name)
+		}
 	}
+	sort.Strings(names)
+	if len(unitsIn(players[attacker], loc)) > 0 {
+		names = append([]string{attacker}, names...)
+	}
+	if len(names) < 2 {
+		return BattleResolved{}, false
+	}
+
+	fighting := []Player{}
+	for _, name := range names {
+		fighting = append(fighting, players[name])
+	}
+	return resolveBattle(rules, fighting, loc, seed), true
+}
 
-	attackerUnits := []Unit{}
-	defenderUnits := []Unit{}
-	for _, unit := range rw.Attacker.Units {
-		if unit.Location == overlappingLocation {
-			attackerUnits = append(attackerUnits, unit)
+func resolveBattle(rules *Rules, players []Player, loc Location, seed int64) BattleResolved {
+	battle := BattleResolved{
+		Location: loc,
+		Sides:    []BattleSide{},
+		Seed:     seed,
+	}
+	for _, p := range players {
+		units := unitsIn(p, loc)
+		battle.Sides = append(battle.Sides, BattleSide{
+			Username: p.Username,
+			Units:    units,
+			Power:    rules.PowerLevel(units),
+		})
+	}
+
+	damage := rules.fight(battle.unitsBySide(), seed)
+	battle.Casualties = []Casualty{}
+	battle.Losses = []StateDelta{}
+	standing := []BattleSide{}
+	for i, side := range battle.Sides {
+		casualties := rules.casualties(side.Username, side.Units, damage[i])
+		battle.Casualties = append(battle.Casualties, casualties...)
+		if len(casualties) > 0 {
+			battle.Losses = append(battle.Losses, lossOf(players[i], casualties))
 		}
+		if len(side.Units) > killed(casualties) {
+			standing = append(standing, side)
+		}
+	}
+
+	// Whoever still holds the location won; if several do, the strongest
+	sort.SliceStable(standing, func(i, j int) bool { return standing[i].Power > standing[j].Power })
+	if len(standing) == 1 || (len(standing) > 1 && standing[0].Power > standing[1].Power) {
+		battle.Winner = standing[0].Username
+	}
+	return battle
+}
+
+func (b BattleResolved) unitsBySide() [][]Unit {
+	units := [][]Unit{}
+	for _, side := range b.Sides {
+		units = append(units, side.Units)
+	}
+	return units
+}
+
+// Attacker is the player whose move started the battle, or whoever is
+// first by username if they had left by the time it was fought.
+func (b BattleResolved) Attacker() string {
+	if len(b.Sides) == 0 {
+		return ""
+	}
+	return b.Sides[0].Username
+}
+
+func (b BattleResolved) usernames() []string {
+	names := []string{}
+	for _, side := range b.Sides {
+		names = append(names, side.Username)
 	}
-	for _, unit := range rw.Defender.Units {
-		if unit.Location == overlappingLocation {
-			defenderUnits = append(defenderUnits, unit)
+	return names
+}
+
+func (b BattleResolved) involves(username string) bool {
+	for _, side := range b.Sides {
+		if side.Username == username {
+			return true
 		}
 	}
+	return false
+}
 
-	fmt.Printf("%s's units:\n", rw.Attacker.Username)
-	for _, unit := range attackerUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
+func killed(casualties []Casualty) int {
+	n := 0
+	for _, c := range casualties {
+		if c.Killed {
+			n++
+		}
 	}
-	fmt.Printf("%s's units:\n", rw.Defender.Username)
-	for _, unit := range defenderUnits {
-		fmt.Printf("  * %v\n", unit.Rank)
+	return n
+}
+
+// unitsIn lists p's units at loc, by ID.
+func unitsIn(p Player, loc Location) []Unit {
+	units := []Unit{}
+	for _, unit := range p.Units {
+		if unit.Location == loc {
+			units = append(units, unit)
+		}
 	}
-	attackerPower := unitsToPowerLevel(attackerUnits)
-	defenderPower := unitsToPowerLevel(defenderUnits)
-	fmt.Printf("Attacker has a power level of %v\n", attackerPower)
-	fmt.Printf("Defender has a power level of %v\n", defenderPower)
-	if attackerPower > defenderPower {
-		fmt.Printf("%s has won the war!\n", rw.Attacker.Username)
-		if player.Username == rw.Defender.Username {
-			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Attacker.Username, rw.Defender.Username
+	sort.Slice(units, func(i, j int) bool { return units[i].ID < units[j].ID })
+	return units
+}
+
+// lossOf removes p's dead units and updates the health of the wounded.
+func lossOf(p Player, casualties []Casualty) StateDelta {
+	delta := StateDelta{
+		Username: p.Username,
+		Version:  p.Version + 1,
+		Units:    []Unit{},
+		Removed:  []int{},
+	}
+	for _, c := range casualties {
+		if c.Killed {
+			delta.Removed = append(delta.Removed, c.Unit.ID)
+		} else {
+			delta.Units = append(delta.Units, c.Unit)
+		}
+	}
+	return delta
+}
+
+// ApplyWar shows the server's verdict on every battle the player is in,
+// updates their units, and sums the battles up in one outcome.
+func (gs *GameState) ApplyWar(war WarResolved) WarOutcome {
+	username := gs.GetUsername()
+	outcomes := []WarOutcome{}
+	for _, battle := range war.Battles {
+		if battle.involves(username) {
+			outcomes = append(outcomes, gs.applyBattle(battle))
+		}
+	}
+	if len(outcomes) == 0 {
+		fmt.Println()
+		fmt.Printf("%s has gone to war in %s; %s, you are not involved.\n", war.Attacker, joinLocations(war.locations()), username)
+		return WarOutcomeNotInvolved
+	}
+
+	outcome := CombineOutcomes(outcomes...)
+	if len(outcomes) > 1 {
+		switch outcome {
+		case WarOutcomeYouWon:
+			fmt.Printf("You won all %d battles!\n", len(outcomes))
+		case WarOutcomeOpponentWon:
+			fmt.Printf("You lost all %d battles!\n", len(outcomes))
+		default:
+			fmt.Printf("Across %d battles, the war ended in a draw!\n", len(outcomes))
 		}
-		return WarOutcomeYouWon, rw.Attacker.Username, rw.Defender.Username
-	} else if defenderPower > attackerPower {
-		fmt.Printf("%s has won the war!\n", rw.Defender.Username)
-		if player.Username == rw.Attacker.Username {
-			fmt.Println("You have lost the war!")
-			gs.removeUnitsInLocation(overlappingLocation)
-			fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-			return WarOutcomeOpponentWon, rw.Defender.Username, rw.Attacker.Username
+	}
+	return outcome
+}
+
+// CombineOutcomes sums up several battles: won if none were lost and at
+// least one was won, lost the other way round, otherwise a draw. Battles
+// the player wasn't in don't count.
+func CombineOutcomes(outcomes ...WarOutcome) WarOutcome {
+	won, lost, involved := 0, 0, 0
+	for _, outcome := range outcomes {
+		switch outcome {
+		case WarOutcomeNotInvolved:
+			continue
+		case WarOutcomeYouWon:
+			won++
+		case WarOutcomeOpponentWon:
+			lost++
 		}
-		return WarOutcomeYouWon, rw.Defender.Username, rw.Attacker.Username
+		involved++
 	}
-	fmt.Println("The war ended in a draw!")
-	fmt.Printf("Your units in %s have been killed.\n", overlappingLocation)
-	gs.removeUnitsInLocation(overlappingLocation)
-	return WarOutcomeDraw, rw.Attacker.Username, rw.Defender.Username
+	switch {
+	case involved == 0:
+		return WarOutcomeNotInvolved
+	case won > 0 && lost == 0:
+		return WarOutcomeYouWon
+	case lost > 0 && won == 0:
+		return WarOutcomeOpponentWon
+	}
+	return WarOutcomeDraw
 }
 
-func unitsToPowerLevel(units []Unit) int {
-	power := 0
-	for _, unit := range units {
-		if unit.Rank == RankArtillery {
-			power += 10
+func (gs *GameState) applyBattle(b BattleResolved) WarOutcome {
+	defer fmt.Println("------------------------")
+	fmt.Println()
+	fmt.Println("==== War Declared ====")
+	fmt.Printf("%s has declared war on %s in %s!\n", b.Attacker(), joinNames(b.usernames()[1:]), b.Location)
+
+	username := gs.GetUsername()
+	for _, side := range b.Sides {
+		fmt.Printf("%s has a power level of %v\n", side.Username, side.Power)
+	}
+	for _, c := range b.Casualties {
+		if c.Username == username {
+			fmt.Printf("Your %s\n", c.describe())
 		}
-		if unit.Rank == RankCavalry {
-			power += 5
+	}
+	// A loss that arrives ahead of an earlier delta is left to the state
+	// queue, which delivers them in order
+	for _, loss := range b.Losses {
+		if loss.Username == username {
+			gs.ApplyDelta(loss)
 		}
-		if unit.Rank == RankInfantry {
-			power += 1
+	}
+
+	if b.Winner == "" {
+		fmt.Println("The war ended in a draw!")
+		return WarOutcomeDraw
+	}
+	fmt.Printf("%s has won the war!\n", b.Winner)
+	if b.Winner == username {
+		return WarOutcomeYouWon
+	}
+	fmt.Println("You have lost the war!")
+	return WarOutcomeOpponentWon
+}
+
+func (war WarResolved) locations() []Location {
+	locations := []Location{}
+	for _, battle := range war.Battles {
+		locations = append(locations, battle.Location)
+	}
+	return locations
+}
+
+// LogMessage is how the war is recorded in the game logs, a sentence per
+// battle.
+func (war WarResolved) LogMessage() string {
+	lines := []string{}
+	for _, battle := range war.Battles {
+		lines = append(lines, battle.LogMessage())
+	}
+	return strings.Join(lines, "; ")
+}
+
+// LogMessage is how the battle is recorded in the game logs.
+func (b BattleResolved) LogMessage() string {
+	msg := fmt.Sprintf("A war between %s resulted in a draw", joinNames(b.usernames()))
+	if b.Winner != "" {
+		losers := []string{}
+		for _, name := range b.usernames() {
+			if name != b.Winner {
+				losers = append(losers, name)
+			}
 		}
+		msg = fmt.Sprintf("%s won a war against %s", b.Winner, joinNames(losers))
+	}
+	msg = fmt.Sprintf("%s in %s", msg, b.Location)
+	if len(b.Casualties) == 0 {
+		return msg
+	}
+	lines := []string{}
+	for _, c := range b.Casualties {
+		lines = append(lines, c.Username+"'s "+c.describe())
+	}
+	return msg + ": " + strings.Join(lines, ", ")
+}
+
+func (c Casualty) describe() string {
+	if c.Killed {
+		return fmt.Sprintf("%s %d was killed", c.Unit.Rank, c.Unit.ID)
+	}
+	return fmt.Sprintf("%s %d took %d damage", c.Unit.Rank, c.Unit.ID, c.Damage)
+}
+
+func joinLocations(locations []Location) string {
+	names := []string{}
+	for _, loc := range locations {
+		names = append(names, string(loc))
+	}
+	return joinNames(names)
+}
+
+// joinNames lists names as "a, b and c".
+func joinNames(names []string) string {
+	if len(names) < 2 {
+		return strings.Join(names, "")
 	}
-	return power
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
 }
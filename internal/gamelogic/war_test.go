@@ -0,0 +1,28 @@
+package gamelogic
+
+import "testing"
+
+func TestBattleLogMessage(t *testing.T) {
+	sides := []BattleSide{{Username: "alice"}, {Username: "bob"}}
+	wounded := Casualty{Username: "bob", Unit: Unit{ID: 2, Rank: RankInfantry}, Damage: 1}
+
+	tests := []struct {
+		name   string
+		battle BattleResolved
+		want   string
+	}{
+		{"draw without casualties", BattleResolved{Location: "europe", Sides: sides},
+			"A war between alice and bob resulted in a draw in europe"},
+		{"win without casualties", BattleResolved{Location: "asia", Sides: sides, Winner: "alice"},
+			"alice won a war against bob in asia"},
+		{"win with casualties", BattleResolved{Location: "asia", Sides: sides, Winner: "alice", Casualties: []Casualty{wounded}},
+			"alice won a war against bob in asia: bob's infantry 2 took 1 damage"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.battle.LogMessage(); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package gamelogic
+
+import (
+	"sync"
+)
+
+// World is the server's canonical copy of every player's units. Commands are
+// validated against it and turned into deltas; nothing changes until a
+// delta is applied.
+type World struct {
+	rules *Rules
+
+	mu      sync.RWMutex
+	players map[string]Player
+}
+
+func NewWorld(rules *Rules, players map[string]Player) *World {
+	w := &World{
+		rules:   rules,
+		players: map[string]Player{},
+	}
+	for username, p := range players {
+		w.players[username] = copyPlayer(p)
+	}
+	return w
+}
+
+// Player returns a copy of username's state, empty if they have never
+// played.
+func (w *World) Player(username string) Player {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	p, ok := w.players[username]
+	if !ok {
+		return Player{Username: username, Units: map[int]Unit{}}
+	}
+	return copyPlayer(p)
+}
+
+func (w *World) Snapshot() map[string]Player {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	players := map[string]Player{}
+	for username, p := range w.players {
+		players[username] = copyPlayer(p)
+	}
+	return players
+}
+
+// Preview is the snapshot the world would have after applying deltas, for
+// saving before the change is made.
+func (w *World) Preview(deltas ...StateDelta) map[string]Player {
+	players := w.Snapshot()
+	for _, d := range deltas {
+		applyToPlayers(players, d)
+	}
+	return players
+}
+
+func (w *World) Apply(d StateDelta) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	applyToPlayers(w.players, d)
+}
+
+func applyToPlayers(players map[string]Player, d StateDelta) {
+	p, ok := players[d.Username]
+	if !ok {
+		p = Player{Username: d.Username, Units: map[int]Unit{}}
+	}
+	applyDelta(&p, d)
+	players[d.Username] = p
+}
+
+func applyDelta(p *Player, d StateDelta) {
+	for _, unit := range d.Units {
+		p.Units[unit.ID] = unit
+		if unit.ID >= p.NextUnitID {
+			p.NextUnitID = unit.ID + 1
+		}
+	}
+	for _, id := range d.Removed {
+		delete(p.Units, id)
+	}
+	p.Version = d.Version
+}
+
+func copyPlayer(p Player) Player {
+	Units := map[int]Unit{}
+	for k, v := range p.Units {
+		Units[k] = v
+	}
+	return Player{
+		Username:   p.Username,
+		Units:      Units,
+		Version:    p.Version,
+		NextUnitID: p.NextUnitID,
+	}
+}
@@ -0,0 +1,206 @@
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrClosed is returned by writes to a store that has been handed over.
+var ErrClosed = errors.New("outbox closed")
+
+// Message is an outgoing publish that has been committed but not yet
+// confirmed by the broker.
+type Message struct {
+	ID         uint64
+	Exchange   string
+	Key        string
+	Publishing amqp.Publishing
+}
+
+type record struct {
+	State   json.RawMessage
+	NextID  uint64
+	Pending []Message
+}
+
+// Store keeps the latest state snapshot and the messages describing how it
+// got there in a single file, so neither can be saved without the other.
+type Store struct {
+	path string
+	// lock is held on path+".lock" for as long as the store is open; the
+	// file itself is replaced on every write, so it can't carry the lock
+	lock *os.File
+
+	mu     sync.Mutex
+	rec    record
+	notify chan struct{}
+	closed bool
+}
+
+// Open takes exclusive ownership of the outbox at path. It fails rather
+// than waits while another store, in this process or any other sharing the
+// file, still has it open.
+func Open(path string) (*Store, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open outbox lock: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("outbox %s is still held by another owner: %v", path, err)
+	}
+
+	s := &Store{
+		path:   path,
+		lock:   lock,
+		rec:    record{NextID: 1},
+		notify: make(chan struct{}, 1),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("could not read outbox: %v", err)
+	}
+	if err := json.Unmarshal(data, &s.rec); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("could not decode outbox %s: %v", path, err)
+	}
+	if len(s.rec.Pending) > 0 {
+		s.signal()
+	}
+	return s, nil
+}
+
+// Close hands the outbox over to whoever opens it next. Writes already
+// under way finish first; any later Commit, or a relay still marking
+// messages sent, gets ErrClosed rather than overwrite the new owner's file.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.lock.Close()
+}
+
+// State decodes the last committed state into v. It reports false if nothing
+// has been committed yet.
+func (s *Store) State(v any) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.rec.State) == 0 {
+		return false, nil
+	}
+	return true, json.Unmarshal(s.rec.State, v)
+}
+
+// Commit saves state together with msgs. Only once it returns nil should the
+// caller apply the change in memory; the relay takes care of publishing.
+func (s *Store) Commit(state any, msgs ...Message) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not encode state: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	rec := s.rec
+	rec.State = data
+	rec.Pending = append([]Message{}, s.rec.Pending...)
+	for _, msg := range msgs {
+		msg.ID = rec.NextID
+		rec.NextID++
+		rec.Pending = append(rec.Pending, msg)
+	}
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	s.rec = rec
+	if len(msgs) > 0 {
+		s.signal()
+	}
+	return nil
+}
+
+func (s *Store) pending() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message{}, s.rec.Pending...)
+}
+
+func (s *Store) markSent(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	rec := s.rec
+	rec.Pending = []Message{}
+	for _, msg := range s.rec.Pending {
+		if msg.ID != id {
+			rec.Pending = append(rec.Pending, msg)
+		}
+	}
+
+	if err := s.write(rec); err != nil {
+		return err
+	}
+	s.rec = rec
+	return nil
+}
+
+func (s *Store) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// write replaces the outbox file via rename so a crash leaves either the old
+// or the new record on disk, never a mix.
+func (s *Store) write(rec record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("could not encode outbox: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("could not create outbox file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write outbox: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync outbox: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not close outbox: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("could not replace outbox: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package outbox
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreHandover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "world.outbox.json")
+
+	old, err := Open(path)
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	if err := old.Commit(1, Message{Key: "state.alice"}); err != nil {
+		t.Fatalf("committing: %v", err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("a second store opened the outbox while the first held it")
+	}
+
+	old.Close()
+	next, err := Open(path)
+	if err != nil {
+		t.Fatalf("taking over: %v", err)
+	}
+
+	var state int
+	if ok, err := next.State(&state); !ok || err != nil || state != 1 {
+		t.Fatalf("took over state %d (%v, %v), want 1", state, ok, err)
+	}
+	if err := next.Commit(2); err != nil {
+		t.Fatalf("committing after takeover: %v", err)
+	}
+
+	// The old owner's relay may still be finishing up
+	if err := old.markSent(1); !errors.Is(err, ErrClosed) {
+		t.Errorf("old store marked a message sent after handover: %v", err)
+	}
+	if err := old.Commit(3); !errors.Is(err, ErrClosed) {
+		t.Errorf("old store committed after handover: %v", err)
+	}
+
+	// What's on disk is still the new owner's
+	next.Close()
+	final, err := Open(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer final.Close()
+	if ok, err := final.State(&state); !ok || err != nil || state != 2 {
+		t.Errorf("saved state is %d, want 2", state)
+	}
+	if got := len(final.pending()); got != 1 {
+		t.Errorf("got %d pending messages, want the 1 the old store tried to mark sent", got)
+	}
+}
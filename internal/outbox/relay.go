@@ -0,0 +1,121 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	minRetryDelay = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+// Relay publishes the store's pending messages in order on a confirm-mode
+// channel and only drops them from the store once the broker acks them.
+type Relay struct {
+	conn  *amqp.Connection
+	store *Store
+	ch    *amqp.Channel
+}
+
+func NewRelay(conn *amqp.Connection, store *Store) *Relay {
+	return &Relay{
+		conn:  conn,
+		store: store,
+	}
+}
+
+// Run relays until ctx is done, retrying failed publishes with backoff.
+func (r *Relay) Run(ctx context.Context) {
+	defer r.closeChannel()
+
+	delay := minRetryDelay
+	for {
+		err := r.flush(ctx)
+		if err == nil {
+			delay = minRetryDelay
+			select {
+			case <-r.store.notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		fmt.Printf("outbox relay: %v (retrying in %v)\n", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (r *Relay) flush(ctx context.Context) error {
+	for _, msg := range r.store.pending() {
+		if err := r.publish(ctx, msg); err != nil {
+			return err
+		}
+		if err := r.store.markSent(msg.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Relay) publish(ctx context.Context, msg Message) error {
+	ch, err := r.channel()
+	if err != nil {
+		return err
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, msg.Exchange, msg.Key, false, false, msg.Publishing)
+	if err != nil {
+		r.closeChannel()
+		return fmt.Errorf("error publishing message %d: %v", msg.ID, err)
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("broker nacked message")
+	}
+	return nil
+}
+
+func (r *Relay) channel() (*amqp.Channel, error) {
+	if r.ch != nil && !r.ch.IsClosed() {
+		return r.ch, nil
+	}
+
+	ch, err := r.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("error creating a channel: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("error enabling publisher confirms: %v", err)
+	}
+	r.ch = ch
+	return ch, nil
+}
+
+func (r *Relay) closeChannel() {
+	if r.ch != nil {
+		r.ch.Close()
+		r.ch = nil
+	}
+}
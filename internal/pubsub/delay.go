@@ -0,0 +1,58 @@
+package pubsub
+
+import (
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const delayQueuePrefix = "peril_delay"
+
+// Delay queues that see no traffic are removed by the broker this long after
+// their TTL would have fired.
+const delayQueueIdle = 1 * time.Minute
+
+// PublishDelayed parks msg in a TTL queue that dead-letters into exchange with
+// key once delay has elapsed, so no broker plugin is needed.
+func PublishDelayed(ch *amqp.Channel, exchange, key string, delay time.Duration, msg amqp.Publishing) error {
+	if delay <= 0 {
+		return ch.Publish(exchange, key, false, false, msg)
+	}
+
+	queueName, err := declareDelayQueue(ch, exchange, key, delay)
+	if err != nil {
+		return err
+	}
+
+	msg.DeliveryMode = amqp.Persistent
+	return ch.Publish("", queueName, false, false, msg)
+}
+
+func PublishDelayedJSON[T any](ch *amqp.Channel, exchange, key string, delay time.Duration, val T, opts ...PublishOption) error {
+	msg, err := EncodeJSON(val, opts...)
+	if err != nil {
+		return err
+	}
+	return PublishDelayed(ch, exchange, key, delay, msg)
+}
+
+// One queue per exchange, key and delay: a queue-level TTL only expires
+// messages at the head, so mixing delays in one queue would hold short
+// delays behind long ones.
+func declareDelayQueue(ch *amqp.Channel, exchange, key string, delay time.Duration) (string, error) {
+	ttl := delay.Milliseconds()
+	queueName := fmt.Sprintf("%s.%s.%s.%d", delayQueuePrefix, exchange, key, ttl)
+
+	args := amqp.Table{
+		"x-message-ttl":             ttl,
+		"x-dead-letter-exchange":    exchange,
+		"x-dead-letter-routing-key": key,
+		"x-expires":                 ttl + delayQueueIdle.Milliseconds(),
+	}
+	_, err := ch.QueueDeclare(queueName, true, false, false, false, args)
+	if err != nil {
+		return "", fmt.Errorf("error declaring delay queue: %v", err)
+	}
+	return queueName, nil
+}
@@ -0,0 +1,45 @@
+package pubsub
+
+import (
+	"fmt"
+	"sort"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ConsumerStatus describes one running subscription and how many messages
+// are waiting in its queue.
+type ConsumerStatus struct {
+	Queue string `json:"queue"`
+	Lag   int    `json:"lag"`
+}
+
+// Consumers reports every running subscription, sorted by queue. Lag comes
+// from a passive declare on conn, so it is a point-in-time estimate.
+func Consumers(conn *amqp.Connection) ([]ConsumerStatus, error) {
+	consumers.Lock()
+	queues := map[string]struct{}{}
+	for c := range consumers.running {
+		queues[c.queue] = struct{}{}
+	}
+	consumers.Unlock()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("error creating a channel: %v", err)
+	}
+	defer ch.Close()
+
+	statuses := []ConsumerStatus{}
+	for queue := range queues {
+		q, err := ch.QueueDeclarePassive(queue, false, false, false, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error inspecting queue %s: %v", queue, err)
+		}
+		statuses = append(statuses, ConsumerStatus{Queue: queue, Lag: q.Messages})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Queue < statuses[j].Queue
+	})
+	return statuses, nil
+}
@@ -0,0 +1,108 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	leaderRetryInterval = 2 * time.Second
+	// After failing to take over, leave the others time to try first
+	leaderFailedBackoff = 10 * time.Second
+)
+
+// Election makes at most one instance the leader at a time: the leader is
+// whoever holds the exclusive consumer on the lease queue. The broker drops
+// the lease along with the leader's channel or connection, and a follower
+// takes over on its next attempt.
+type Election struct {
+	conn  *amqp.Connection
+	queue string
+
+	mu       sync.Mutex
+	leader   bool
+	onChange func(leader bool) error
+}
+
+// ElectLeader campaigns for leadership on queue until ctx is done. onChange
+// is called whenever this instance gains or loses leadership. If it fails to
+// take over, the lease is given up so another instance can.
+func ElectLeader(ctx context.Context, conn *amqp.Connection, queue string, onChange func(leader bool) error) *Election {
+	e := &Election{
+		conn:     conn,
+		queue:    queue,
+		onChange: onChange,
+	}
+	go e.run(ctx)
+	return e
+}
+
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+func (e *Election) run(ctx context.Context) {
+	for {
+		retry := leaderRetryInterval
+		ch, err := e.acquire()
+		if err == nil {
+			if err := e.setLeader(true); err != nil {
+				fmt.Printf("giving up leadership: %v\n", err)
+				ch.Close()
+				retry = leaderFailedBackoff
+			} else {
+				select {
+				case <-ch.NotifyClose(make(chan *amqp.Error, 1)):
+				case <-ctx.Done():
+					ch.Close()
+				}
+			}
+			e.setLeader(false)
+		}
+
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Election) acquire() (*amqp.Channel, error) {
+	ch, err := e.conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("error creating a channel: %v", err)
+	}
+
+	_, err = ch.QueueDeclare(e.queue, false, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+
+	// Refused while another instance holds the lease
+	_, err = ch.Consume(e.queue, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (e *Election) setLeader(leader bool) error {
+	e.mu.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	e.mu.Unlock()
+
+	if changed && e.onChange != nil {
+		return e.onChange(leader)
+	}
+	return nil
+}
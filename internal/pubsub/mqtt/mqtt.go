@@ -0,0 +1,154 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const DefaultBrokerURL = "tcp://localhost:1883"
+
+// InboundRoot prefixes topics that the bridge forwards into RabbitMQ. Kept
+// apart from the outbound topics so the bridge never hears its own echo.
+const InboundRoot = "to_peril"
+
+// Connect opens a persistent session so QoS 1 messages a handler left
+// unacknowledged are redelivered when the client reconnects.
+func Connect(brokerURL, clientID string) (paho.Client, error) {
+	opts := paho.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID(clientID).
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(true)
+
+	client := paho.NewClient(opts)
+	token := client.Connect()
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("error connecting to mqtt broker: %v", err)
+	}
+	return client, nil
+}
+
+// Topic maps an exchange and routing key (or binding pattern) to the MQTT
+// topic it is bridged to: "peril_topic", "army_moves.*" becomes
+// "peril_topic/army_moves/+".
+func Topic(exchange, key string) string {
+	words := strings.Split(key, ".")
+	for i, word := range words {
+		if word == "*" {
+			words[i] = "+"
+		}
+	}
+	return exchange + "/" + strings.Join(words, "/")
+}
+
+// InboundTopic is the topic MQTT clients publish to for the bridge to relay
+// to exchange with key.
+func InboundTopic(exchange, key string) string {
+	return InboundRoot + "/" + Topic(exchange, key)
+}
+
+// ParseTopic is the inverse of Topic, with or without InboundRoot.
+func ParseTopic(topic string) (exchange, key string, err error) {
+	topic = strings.TrimPrefix(topic, InboundRoot+"/")
+	exchange, path, ok := strings.Cut(topic, "/")
+	if !ok || exchange == "" || path == "" {
+		return "", "", fmt.Errorf("%s is not a bridged topic", topic)
+	}
+	words := strings.Split(path, "/")
+	for i, word := range words {
+		if word == "+" {
+			words[i] = "*"
+		}
+	}
+	return exchange, strings.Join(words, "."), nil
+}
+
+func Publish(client paho.Client, topic string, payload []byte) error {
+	token := client.Publish(topic, 1, false, payload)
+	token.Wait()
+	return token.Error()
+}
+
+func PublishJSON[T any](client paho.Client, exchange, key string, val T) error {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return Publish(client, InboundTopic(exchange, key), bytes)
+}
+
+func PublishGob[T any](client paho.Client, exchange, key string, val T) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(val); err != nil {
+		return err
+	}
+	return Publish(client, InboundTopic(exchange, key), buf.Bytes())
+}
+
+func SubscribeJSON[T any](
+	client paho.Client,
+	exchange,
+	key string,
+	handler func(T) pubsub.AckType,
+) error {
+	return subscribe(client, exchange, key, handler,
+		func(data []byte) (T, error) {
+			var strct T
+			err := json.Unmarshal(data, &strct)
+			return strct, err
+		},
+	)
+}
+
+func SubscribeGob[T any](
+	client paho.Client,
+	exchange,
+	key string,
+	handler func(T) pubsub.AckType,
+) error {
+	return subscribe(client, exchange, key, handler,
+		func(data []byte) (T, error) {
+			buf := bytes.NewBuffer(data)
+			dec := gob.NewDecoder(buf)
+
+			var strct T
+			err := dec.Decode(&strct)
+			return strct, err
+		},
+	)
+}
+
+// MQTT has no nack: Ack and NackDiscard both acknowledge the message, while
+// NackRequeue withholds the ack so the broker redelivers it to the session.
+func subscribe[T any](
+	client paho.Client,
+	exchange,
+	key string,
+	handler func(T) pubsub.AckType,
+	unmarshaller func([]byte) (T, error),
+) error {
+	token := client.Subscribe(Topic(exchange, key), 1, func(_ paho.Client, message paho.Message) {
+		data, err := unmarshaller(message.Payload())
+		if err != nil {
+			fmt.Printf("error unmarshalling data consumed by client: %v\n", err)
+		}
+
+		switch ackType := handler(data); ackType {
+		case pubsub.Ack, pubsub.NackDiscard:
+			message.Ack()
+		case pubsub.NackRequeue:
+			fmt.Println("Leaving message unacknowledged for redelivery...")
+		}
+	})
+	token.Wait()
+	return token.Error()
+}
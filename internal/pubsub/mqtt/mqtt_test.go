@@ -0,0 +1,209 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/mqtt"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/mqtt/mqtttest"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const waitFor = 2 * time.Second
+
+func connect(t *testing.T) (*mqtttest.Broker, paho.Client) {
+	t.Helper()
+	broker, err := mqtttest.NewBroker()
+	if err != nil {
+		t.Fatalf("starting broker: %v", err)
+	}
+	client, err := mqtt.Connect(broker.URL(), "peril_test")
+	if err != nil {
+		broker.Close()
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() {
+		client.Disconnect(0)
+		broker.Close()
+	})
+	return broker, client
+}
+
+func TestTopicRoundTrip(t *testing.T) {
+	tests := []struct {
+		exchange string
+		key      string
+		want     string
+	}{
+		{routing.ExchangePerilTopic, "army_moves.*", "peril_topic/army_moves/+"},
+		{routing.ExchangePerilTopic, "war.alice", "peril_topic/war/alice"},
+		{routing.ExchangePerilDirect, routing.PauseKey, "peril_direct/pause"},
+	}
+	for _, tc := range tests {
+		got := mqtt.Topic(tc.exchange, tc.key)
+		if got != tc.want {
+			t.Errorf("Topic(%q, %q) = %q, want %q", tc.exchange, tc.key, got, tc.want)
+		}
+		for _, topic := range []string{got, mqtt.InboundTopic(tc.exchange, tc.key)} {
+			exchange, key, err := mqtt.ParseTopic(topic)
+			if err != nil || exchange != tc.exchange || key != tc.key {
+				t.Errorf("ParseTopic(%q) = %q, %q, %v", topic, exchange, key, err)
+			}
+		}
+	}
+}
+
+// "*" becomes "+", which matches exactly one topic level, so a sharded log
+// key only reaches subscriptions with a level for the shard
+func TestShardedLogLevels(t *testing.T) {
+	_, client := connect(t)
+
+	sharded := make(chan routing.GameLog, 1)
+	unsharded := make(chan routing.GameLog, 1)
+	for pattern, got := range map[string]chan routing.GameLog{
+		routing.GameLogSlug + ".*.*": sharded,
+		routing.GameLogSlug + ".*":   unsharded,
+	} {
+		err := mqtt.SubscribeGob(client, routing.ExchangePerilTopic, pattern,
+			func(gl routing.GameLog) pubsub.AckType {
+				got <- gl
+				return pubsub.Ack
+			},
+		)
+		if err != nil {
+			t.Fatalf("subscribing to %s: %v", pattern, err)
+		}
+	}
+
+	want := routing.GameLog{Username: "alice", Message: "hello"}
+	publishLog(t, client, want)
+	select {
+	case gl := <-sharded:
+		if gl.Username != want.Username || gl.Message != want.Message {
+			t.Errorf("got %+v, want %+v", gl, want)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("message was never delivered")
+	}
+	select {
+	case gl := <-unsharded:
+		t.Errorf("%s.* got %+v", routing.GameLogSlug, gl)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// MQTT has no nack, so only NackRequeue withholds the PUBACK
+func TestAckTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		ack  pubsub.AckType
+		acks int
+	}{
+		{"ack sends a puback", pubsub.Ack, 1},
+		{"nack requeue withholds it", pubsub.NackRequeue, 0},
+		{"nack discard sends a puback", pubsub.NackDiscard, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			broker, client := connect(t)
+
+			delivered := make(chan struct{}, 1)
+			err := mqtt.SubscribeJSON(client, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".*",
+				func(move map[string]any) pubsub.AckType {
+					delivered <- struct{}{}
+					return tc.ack
+				},
+			)
+			if err != nil {
+				t.Fatalf("subscribing: %v", err)
+			}
+			if err := mqtt.Publish(client, mqtt.Topic(routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice"), []byte(`{"ID":1}`)); err != nil {
+				t.Fatalf("publishing: %v", err)
+			}
+
+			select {
+			case <-delivered:
+			case <-time.After(waitFor):
+				t.Fatal("message was never delivered")
+			}
+			deadline := time.Now().Add(waitFor)
+			for broker.Acks() < tc.acks && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if got := broker.Acks(); got != tc.acks {
+				t.Errorf("got %d pubacks, want %d", got, tc.acks)
+			}
+		})
+	}
+}
+
+// A message left unacknowledged stays with the session, so the broker sends
+// it again once the client reconnects
+func TestRequeueRedeliveredOnReconnect(t *testing.T) {
+	broker, client := connect(t)
+
+	deliveries := make(chan routing.GameLog, 10)
+	n := 0
+	err := mqtt.SubscribeGob(client, routing.ExchangePerilTopic, routing.GameLogSlug+".*.*",
+		func(gl routing.GameLog) pubsub.AckType {
+			n++
+			deliveries <- gl
+			if n == 1 {
+				return pubsub.NackRequeue
+			}
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+	want := routing.GameLog{Username: "alice", Message: "hello"}
+	publishLog(t, client, want)
+
+	select {
+	case <-deliveries:
+	case <-time.After(waitFor):
+		t.Fatal("message was never delivered")
+	}
+	// paho reconnects on its own and resumes the session
+	broker.Drop()
+	select {
+	case gl := <-deliveries:
+		if gl.Message != want.Message {
+			t.Errorf("redelivered %+v, want %+v", gl, want)
+		}
+	case <-time.After(2 * waitFor):
+		t.Fatal("message was never redelivered")
+	}
+
+	deadline := time.Now().Add(waitFor)
+	for broker.Acks() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := broker.Acks(); got != 1 {
+		t.Errorf("got %d pubacks, want 1", got)
+	}
+	select {
+	case gl := <-deliveries:
+		t.Errorf("delivered again after the ack: %+v", gl)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// publishLog publishes gl where the bridge would, under its shard.
+func publishLog(t *testing.T, client paho.Client, gl routing.GameLog) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(gl); err != nil {
+		t.Fatal(err)
+	}
+	key := pubsub.ShardKey(routing.GameLogSlug, routing.GameLogShards, gl.Username)
+	if err := mqtt.Publish(client, mqtt.Topic(routing.ExchangePerilTopic, key), buf.Bytes()); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+}
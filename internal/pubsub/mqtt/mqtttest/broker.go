@@ -0,0 +1,416 @@
+// Package mqtttest provides an embedded MQTT 3.1.1 broker, good enough to
+// exercise the mqtt package and the bridge without a real broker. It keeps
+// persistent sessions in memory and resends their unacknowledged QoS 1
+// messages when a client resumes one, but has no retained messages.
+package mqtttest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+)
+
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+type Broker struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	acks     int
+	wg       sync.WaitGroup
+}
+
+type client struct {
+	nc      net.Conn
+	out     chan []byte
+	session *session
+}
+
+// session outlives its client unless it is clean.
+type session struct {
+	id     string
+	clean  bool
+	client *client // nil while nobody is connected to it
+	filter map[string]byte
+	nextID uint16
+	// QoS 1 messages awaiting a PUBACK, in the order they were published
+	inflight []inflight
+}
+
+type inflight struct {
+	id     uint16
+	packet []byte
+	sent   bool
+}
+
+// NewBroker starts listening on a random local port.
+func NewBroker() (*Broker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &Broker{
+		ln:       ln,
+		sessions: map[string]*session{},
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// URL is the broker address in the form paho expects.
+func (b *Broker) URL() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *Broker) Close() error {
+	err := b.ln.Close()
+	b.wg.Wait()
+	return err
+}
+
+// Acks counts the PUBACKs clients have sent for QoS 1 messages delivered to
+// them.
+func (b *Broker) Acks() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.acks
+}
+
+// Drop cuts every client off without a DISCONNECT, as a network failure
+// would. Persistent sessions stay for the clients to resume.
+func (b *Broker) Drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.sessions {
+		if s.client != nil {
+			s.client.nc.Close()
+		}
+	}
+}
+
+func (b *Broker) accept() {
+	defer b.wg.Done()
+	for {
+		nc, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{
+			nc:  nc,
+			out: make(chan []byte, 1024),
+		}
+		go func() {
+			for p := range c.out {
+				if _, err := nc.Write(p); err != nil {
+					return
+				}
+			}
+		}()
+		go b.serve(c)
+	}
+}
+
+func (b *Broker) serve(c *client) {
+	defer b.disconnect(c)
+	r := bufio.NewReader(c.nc)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+
+		if c.session == nil && header>>4 != packetConnect {
+			return
+		}
+		switch header >> 4 {
+		case packetConnect:
+			if err := b.connect(c, body); err != nil {
+				return
+			}
+		case packetPublish:
+			if err := b.publish(c, header, body); err != nil {
+				return
+			}
+		case packetPuback:
+			if len(body) < 2 {
+				return
+			}
+			b.puback(c, binary.BigEndian.Uint16(body))
+		case packetSubscribe:
+			if err := b.subscribe(c, body); err != nil {
+				return
+			}
+		case packetUnsubscribe:
+			if err := b.unsubscribe(c, body); err != nil {
+				return
+			}
+		case packetPingreq:
+			c.out <- []byte{packetPingresp << 4, 0}
+		case packetDisconnect:
+			return
+		default:
+			return
+		}
+	}
+}
+
+// connect starts or resumes the client's session, and resends whatever the
+// session has that wasn't acknowledged.
+func (b *Broker) connect(c *client, body []byte) error {
+	_, rest, err := readString(body)
+	if err != nil || len(rest) < 4 {
+		return errors.New("malformed connect")
+	}
+	clean := rest[1]&0x02 != 0
+	id, _, err := readString(rest[4:])
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sessions[id]
+	if ok && s.client != nil {
+		// The newest connection takes the session over
+		s.client.nc.Close()
+	}
+	present := byte(1)
+	if !ok || clean {
+		s = &session{id: id, filter: map[string]byte{}}
+		b.sessions[id] = s
+		present = 0
+	}
+	s.clean = clean
+	s.client = c
+	c.session = s
+
+	c.out <- []byte{packetConnack << 4, 2, present, 0}
+	for i, msg := range s.inflight {
+		p := slices.Clone(msg.packet)
+		if msg.sent {
+			p[0] |= 0x08 // DUP
+		}
+		c.out <- p
+		s.inflight[i].sent = true
+	}
+	return nil
+}
+
+func (b *Broker) puback(c *client, id uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.acks++
+	c.session.inflight = slices.DeleteFunc(c.session.inflight, func(msg inflight) bool {
+		return msg.id == id
+	})
+}
+
+func (b *Broker) disconnect(c *client) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(c.out)
+	c.nc.Close()
+	s := c.session
+	if s == nil || s.client != c {
+		return
+	}
+	s.client = nil
+	if s.clean && b.sessions[s.id] == s {
+		delete(b.sessions, s.id)
+	}
+}
+
+func (b *Broker) publish(c *client, header byte, body []byte) error {
+	qos := (header >> 1) & 0x3
+	topic, rest, err := readString(body)
+	if err != nil {
+		return err
+	}
+	if qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("publish missing packet id")
+		}
+		c.out <- []byte{packetPuback << 4, 2, rest[0], rest[1]}
+		rest = rest[2:]
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.sessions {
+		for filter, subQoS := range sub.filter {
+			if !topicMatch(filter, topic) {
+				continue
+			}
+			sub.deliver(topic, rest, min(qos, subQoS))
+			break
+		}
+	}
+	return nil
+}
+
+func (b *Broker) subscribe(c *client, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("subscribe missing packet id")
+	}
+	id, rest := body[:2], body[2:]
+	granted := []byte{}
+
+	b.mu.Lock()
+	for len(rest) > 0 {
+		filter, after, err := readString(rest)
+		if err != nil || len(after) < 1 {
+			b.mu.Unlock()
+			return errors.New("malformed subscribe")
+		}
+		qos := min(after[0]&0x3, 1)
+		c.session.filter[filter] = qos
+		granted = append(granted, qos)
+		rest = after[1:]
+	}
+	b.mu.Unlock()
+
+	c.out <- append(fixedHeader(packetSuback<<4, 2+len(granted)), append(id, granted...)...)
+	return nil
+}
+
+func (b *Broker) unsubscribe(c *client, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("unsubscribe missing packet id")
+	}
+	id, rest := body[:2], body[2:]
+
+	b.mu.Lock()
+	for len(rest) > 0 {
+		filter, after, err := readString(rest)
+		if err != nil {
+			b.mu.Unlock()
+			return err
+		}
+		delete(c.session.filter, filter)
+		rest = after
+	}
+	b.mu.Unlock()
+
+	c.out <- []byte{packetUnsuback << 4, 2, id[0], id[1]}
+	return nil
+}
+
+// deliver sends s a PUBLISH, or keeps it for when the client is back if it
+// is QoS 1. Callers hold b.mu.
+func (s *session) deliver(topic string, payload []byte, qos byte) {
+	variable := appendString(nil, topic)
+	var id uint16
+	if qos > 0 {
+		s.nextID++
+		if s.nextID == 0 {
+			s.nextID = 1
+		}
+		id = s.nextID
+		variable = binary.BigEndian.AppendUint16(variable, id)
+	}
+	p := fixedHeader(packetPublish<<4|qos<<1, len(variable)+len(payload))
+	p = append(p, variable...)
+	p = append(p, payload...)
+
+	if qos > 0 {
+		s.inflight = append(s.inflight, inflight{id: id, packet: p, sent: s.client != nil})
+	}
+	if s.client != nil {
+		s.client.out <- p
+	}
+}
+
+func fixedHeader(first byte, length int) []byte {
+	p := []byte{first}
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		p = append(p, digit)
+		if length == 0 {
+			return p
+		}
+	}
+}
+
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("short string")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return "", nil, errors.New("short string")
+	}
+	return string(data[2 : 2+n]), data[2+n:], nil
+}
+
+func appendString(p []byte, s string) []byte {
+	p = binary.BigEndian.AppendUint16(p, uint16(len(s)))
+	return append(p, s...)
+}
+
+// topicMatch implements MQTT filters: "+" is one level, "#" is the rest.
+func topicMatch(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type Overflow string
+
+// Drop-head and reject-publish-dlx both dead-letter to peril_dlx with the
+// reason "maxlen"; reject-publish just refuses the new message.
+const (
+	OverflowDropHead         Overflow = "drop-head"
+	OverflowRejectPublish    Overflow = "reject-publish"
+	OverflowRejectPublishDLX Overflow = "reject-publish-dlx"
+)
+
+// QueueOption adds arguments to the queue declared by DeclareAndBind.
+type QueueOption func(amqp.Table)
+
+// WithMessageTTL expires messages that sit in the queue longer than ttl.
+// Expired messages are dead-lettered with the reason "expired".
+func WithMessageTTL(ttl time.Duration) QueueOption {
+	return func(args amqp.Table) {
+		args["x-message-ttl"] = ttl.Milliseconds()
+	}
+}
+
+// WithExpires deletes the queue once it has gone unused, with no consumers,
+// for d. Its messages go with it.
+func WithExpires(d time.Duration) QueueOption {
+	return func(args amqp.Table) {
+		args["x-expires"] = d.Milliseconds()
+	}
+}
+
+func WithMaxLength(n int) QueueOption {
+	return func(args amqp.Table) {
+		args["x-max-length"] = n
+	}
+}
+
+func WithOverflow(overflow Overflow) QueueOption {
+	return func(args amqp.Table) {
+		args["x-overflow"] = string(overflow)
+	}
+}
+
+// WithMaxPriority turns the queue into a priority queue accepting message
+// priorities from 0 to max.
+func WithMaxPriority(max uint8) QueueOption {
+	return func(args amqp.Table) {
+		args["x-max-priority"] = int(max)
+	}
+}
+
+// WithDeliveryLimit dead-letters a message with the reason "delivery_limit"
+// once it has been requeued n times. Only quorum queues support it.
+func WithDeliveryLimit(n int) QueueOption {
+	return func(args amqp.Table) {
+		args["x-delivery-limit"] = n
+	}
+}
+
+// PublishOption adjusts a message before it is published.
+type PublishOption func(*amqp.Publishing)
+
+// WithExpiration expires this message if it isn't consumed within ttl.
+func WithExpiration(ttl time.Duration) PublishOption {
+	return func(msg *amqp.Publishing) {
+		msg.Expiration = strconv.FormatInt(ttl.Milliseconds(), 10)
+	}
+}
+
+// WithPriority only has an effect on queues declared with WithMaxPriority.
+func WithPriority(priority uint8) PublishOption {
+	return func(msg *amqp.Publishing) {
+		msg.Priority = priority
+	}
+}
+
+// DeathReason reports why a message on the DLQ was dead-lettered, e.g.
+// "rejected", "expired", "maxlen" or "delivery_limit". It is empty for live
+// messages.
+func DeathReason(d amqp.Delivery) string {
+	reason, _ := d.Headers["x-first-death-reason"].(string)
+	return reason
+}
@@ -0,0 +1,121 @@
+package pubsub
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket: it holds up to burst tokens and refills at
+// rate tokens per second.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *RateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// Allow takes a token if one is available without waiting.
+func (l *RateLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Wait blocks until a token is available and takes it.
+func (l *RateLimiter) Wait() {
+	l.mu.Lock()
+	l.refill(time.Now())
+	l.tokens--
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// KeyedRateLimiter keeps a separate bucket per key (e.g. per username) and
+// counts how often each key went over quota.
+type KeyedRateLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	burst    int
+	limiters map[string]*RateLimiter
+	rejected map[string]int
+}
+
+func NewKeyedRateLimiter(rate float64, burst int) *KeyedRateLimiter {
+	return &KeyedRateLimiter{
+		rate:     rate,
+		burst:    burst,
+		limiters: map[string]*RateLimiter{},
+		rejected: map[string]int{},
+	}
+}
+
+// Allow takes a token from key's bucket. When it can't, the rejection is
+// recorded and the running total for key is returned.
+func (k *KeyedRateLimiter) Allow(key string) (bool, int) {
+	k.mu.Lock()
+	limiter, ok := k.limiters[key]
+	if !ok {
+		limiter = NewRateLimiter(k.rate, k.burst)
+		k.limiters[key] = limiter
+	}
+	k.mu.Unlock()
+
+	if limiter.Allow() {
+		return true, 0
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rejected[key]++
+	return false, k.rejected[key]
+}
+
+type Offender struct {
+	Key      string
+	Rejected int
+}
+
+// Offenders lists every key that went over quota, worst first.
+func (k *KeyedRateLimiter) Offenders() []Offender {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	offenders := []Offender{}
+	for key, rejected := range k.rejected {
+		offenders = append(offenders, Offender{Key: key, Rejected: rejected})
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Rejected != offenders[j].Rejected {
+			return offenders[i].Rejected > offenders[j].Rejected
+		}
+		return offenders[i].Key < offenders[j].Key
+	})
+	return offenders
+}
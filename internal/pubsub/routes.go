@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Route hands the messages a queue receives from exchange under key (which
+// may use topic wildcards) to a handler of their own type.
+type Route struct {
+	exchange string
+	key      string
+	handle   func(amqp.Delivery) AckType
+}
+
+func RouteJSON[T any](exchange, key string, handler func(T) AckType) Route {
+	return Route{
+		exchange: exchange,
+		key:      key,
+		handle: func(message amqp.Delivery) AckType {
+			data, err := unmarshalJSON[T](message.Body)
+			if err != nil {
+				fmt.Printf("error unmarshalling data consumed by client: %v\n", err)
+				return NackDiscard
+			}
+			return handler(data)
+		},
+	}
+}
+
+// SubscribeRoutes binds one queue to every route and consumes it with a
+// single consumer. Unlike a queue per message type, messages of different
+// types are then handled in queue order, which on a queue declared with
+// WithMaxPriority means highest priority first.
+func SubscribeRoutes(
+	conn *amqp.Connection,
+	queueName string,
+	queueType SimpleQueueType,
+	routes []Route,
+	opts ...QueueOption,
+) error {
+	if len(routes) == 0 {
+		return fmt.Errorf("no routes to bind %s to", queueName)
+	}
+	channel, _, err := DeclareAndBind(conn, routes[0].exchange, queueName, routes[0].key, queueType, opts...)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes[1:] {
+		if err := channel.QueueBind(queueName, route.key, route.exchange, false, nil); err != nil {
+			channel.Close()
+			return err
+		}
+	}
+
+	if err = channel.Qos(10, 0, false); err != nil {
+		channel.Close()
+		return err
+	}
+
+	c := trackConsumer(channel, queueName)
+	deliveryCh, err := channel.Consume(queueName, c.tag, false, false, false, false, nil)
+	if err != nil {
+		c.finished()
+		channel.Close()
+		return err
+	}
+
+	go consumeRoutes(c, deliveryCh, routes)
+	return nil
+}
+
+func consumeRoutes(c *consumer, ch <-chan amqp.Delivery, routes []Route) {
+	defer c.finished()
+	for message := range ch {
+		ackType := NackDiscard
+		if route, ok := routeFor(routes, message); ok {
+			ackType = route.handle(message)
+		} else {
+			fmt.Printf("no route for %s/%s, discarding...\n", message.Exchange, message.RoutingKey)
+		}
+		if err := acknowledge(message, ackType); err != nil {
+			fmt.Printf("err handling data: %v\n", err)
+		}
+	}
+}
+
+func routeFor(routes []Route, message amqp.Delivery) (Route, bool) {
+	for _, route := range routes {
+		if route.exchange == message.Exchange && TopicMatch(route.key, message.RoutingKey) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// TopicMatch implements AMQP topic matching: "*" is one word, "#" is zero or
+// more. Keys without wildcards match only themselves, as on a direct
+// exchange.
+func TopicMatch(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	if pattern[0] == "#" {
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(words) == 0 {
+		return false
+	}
+	if pattern[0] != "*" && pattern[0] != words[0] {
+		return false
+	}
+	return matchWords(pattern[1:], words[1:])
+}
@@ -0,0 +1,31 @@
+package pubsub
+
+import "testing"
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"pause", "pause", true},
+		{"pause", "pauses", false},
+		{"army_moves.*", "army_moves.alice", true},
+		{"army_moves.*", "army_moves", false},
+		{"army_moves.*", "army_moves.alice.bob", false},
+		{"game_logs.*.*", "game_logs.0.alice", true},
+		{"game_logs.*.*", "game_logs.alice", false},
+		{"war.#", "war", true},
+		{"war.#", "war.alice.bob", true},
+		{"war.#", "warp.alice", false},
+		{"#.alice", "war.alice", true},
+		{"#", "anything.at.all", true},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.b.b.c", true},
+		{"a.#.c", "a.b.b", false},
+	}
+	for _, tc := range tests {
+		if got := TopicMatch(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("TopicMatch(%q, %q) = %v, want %v", tc.pattern, tc.key, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// DirectReplyTo is RabbitMQ's pseudo-queue for replies that skip declaring a
+// real reply queue.
+const DirectReplyTo = "amq.rabbitmq.reply-to"
+
+const rpcErrorHeader = "x-rpc-error"
+
+var ErrRPCClosed = errors.New("rpc client closed")
+
+type RPCClient struct {
+	ch         *amqp.Channel
+	replyQueue string
+
+	mu      sync.Mutex
+	pending map[string]chan amqp.Delivery
+	closed  bool
+}
+
+// NewRPCClient opens a channel for issuing calls. An empty replyQueue uses
+// direct reply-to, otherwise an exclusive queue with that name is declared.
+func NewRPCClient(conn *amqp.Connection, replyQueue string) (*RPCClient, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("error creating rpc channel: %v", err)
+	}
+
+	if replyQueue == "" {
+		replyQueue = DirectReplyTo
+	} else {
+		_, err = ch.QueueDeclare(replyQueue, false, true, true, false, nil)
+		if err != nil {
+			ch.Close()
+			return nil, fmt.Errorf("error declaring reply queue: %v", err)
+		}
+	}
+
+	// Direct reply-to requires no-ack consumption on the publishing channel
+	replies, err := ch.Consume(replyQueue, "", true, true, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("error consuming replies: %v", err)
+	}
+
+	client := &RPCClient{
+		ch:         ch,
+		replyQueue: replyQueue,
+		pending:    map[string]chan amqp.Delivery{},
+	}
+	go client.dispatch(replies)
+	return client, nil
+}
+
+func (c *RPCClient) dispatch(replies <-chan amqp.Delivery) {
+	for reply := range replies {
+		c.mu.Lock()
+		waiter, ok := c.pending[reply.CorrelationId]
+		delete(c.pending, reply.CorrelationId)
+		c.mu.Unlock()
+
+		if !ok {
+			fmt.Printf("dropping rpc reply with unknown correlation id %q\n", reply.CorrelationId)
+			continue
+		}
+		waiter <- reply
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for id, waiter := range c.pending {
+		close(waiter)
+		delete(c.pending, id)
+	}
+}
+
+func (c *RPCClient) Close() error {
+	return c.ch.Close()
+}
+
+func (c *RPCClient) call(ctx context.Context, exchange, key, contentType string, body []byte) (amqp.Delivery, error) {
+	id, err := newCorrelationID()
+	if err != nil {
+		return amqp.Delivery{}, err
+	}
+
+	waiter := make(chan amqp.Delivery, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return amqp.Delivery{}, ErrRPCClosed
+	}
+	c.pending[id] = waiter
+	c.mu.Unlock()
+
+	msg := amqp.Publishing{
+		ContentType:   contentType,
+		CorrelationId: id,
+		ReplyTo:       c.replyQueue,
+		Body:          body,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Expiration = expirationUntil(deadline)
+	}
+
+	if err := c.ch.PublishWithContext(ctx, exchange, key, false, false, msg); err != nil {
+		c.forget(id)
+		return amqp.Delivery{}, err
+	}
+
+	select {
+	case reply, ok := <-waiter:
+		if !ok {
+			return amqp.Delivery{}, ErrRPCClosed
+		}
+		if reason, ok := reply.Headers[rpcErrorHeader].(string); ok {
+			return amqp.Delivery{}, fmt.Errorf("rpc %s: %s", key, reason)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		c.forget(id)
+		return amqp.Delivery{}, ctx.Err()
+	}
+}
+
+func (c *RPCClient) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+// CallJSON publishes req to exchange/key and waits for the handler's reply
+// until ctx is done.
+func CallJSON[Req, Resp any](ctx context.Context, c *RPCClient, exchange, key string, req Req) (Resp, error) {
+	var resp Resp
+	body, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	reply, err := c.call(ctx, exchange, key, "application/json", body)
+	if err != nil {
+		return resp, err
+	}
+	err = json.Unmarshal(reply.Body, &resp)
+	return resp, err
+}
+
+// ServeJSON declares and binds queueName and answers every request on it with
+// handler's result, sent to the request's reply-to address. Closing the
+// returned channel stops serving.
+func ServeJSON[Req, Resp any](
+	conn *amqp.Connection,
+	exchange,
+	queueName,
+	key string,
+	queueType SimpleQueueType,
+	handler func(Req) (Resp, error),
+) (*amqp.Channel, error) {
+	channel, _, err := DeclareAndBind(conn, exchange, queueName, key, queueType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = channel.Qos(10, 0, false); err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	c := trackConsumer(channel, queueName)
+	deliveryCh, err := channel.Consume(queueName, c.tag, false, false, false, false, nil)
+	if err != nil {
+		c.finished()
+		channel.Close()
+		return nil, err
+	}
+
+	go serveChannel(c, deliveryCh, func(data []byte) ([]byte, error) {
+		req, err := unmarshalJSON[Req](data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode request: %v", err)
+		}
+		resp, err := handler(req)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(resp)
+	}, "application/json")
+	return channel, nil
+}
+
+func serveChannel(c *consumer, ch <-chan amqp.Delivery, handler func([]byte) ([]byte, error), contentType string) {
+	defer c.finished()
+	for message := range ch {
+		if message.ReplyTo == "" {
+			fmt.Println("rpc request has no reply-to, discarding...")
+			message.Nack(false, false)
+			continue
+		}
+
+		reply := amqp.Publishing{
+			ContentType:   contentType,
+			CorrelationId: message.CorrelationId,
+		}
+		body, err := handler(message.Body)
+		if err != nil {
+			reply.Headers = amqp.Table{rpcErrorHeader: err.Error()}
+		} else {
+			reply.Body = body
+		}
+
+		if err := c.ch.Publish("", message.ReplyTo, false, false, reply); err != nil {
+			fmt.Printf("error sending rpc reply: %v\n", err)
+			message.Nack(false, true)
+			continue
+		}
+		message.Ack(false)
+	}
+}
+
+func newCorrelationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating correlation id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// expirationUntil converts a deadline into a per-message expiration so
+// requests nobody answered in time don't linger in the queue.
+func expirationUntil(deadline time.Time) string {
+	ms := time.Until(deadline).Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
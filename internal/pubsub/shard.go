@@ -0,0 +1,208 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ShardFor maps key to one of shards buckets with jump consistent hashing,
+// so growing the shard count only moves about 1/shards of the keys.
+func ShardFor(key string, shards int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	hash := h.Sum64()
+
+	var b, j int64 = -1, 0
+	for j < int64(shards) {
+		b = j
+		hash = hash*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((hash>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardKey is the routing key for a message about key under prefix, e.g.
+// "game_logs.2.alice". All of key's messages land on the same shard queue.
+func ShardKey(prefix string, shards int, key string) string {
+	return fmt.Sprintf("%s.%d.%s", prefix, ShardFor(key, shards), key)
+}
+
+// ShardQueue names shard i's queue, bound to "<prefix>.<i>.*".
+func ShardQueue(prefix string, i int) string {
+	return fmt.Sprintf("%s.shard.%d", prefix, i)
+}
+
+const shardClaimInterval = 5 * time.Second
+
+// ShardClaimer holds exclusive consumers on shard queues. Each shard is
+// consumed by one instance at a time, keeping per-key order. An instance
+// claims up to max free shards, plus any shard that has stayed free for a
+// whole claim interval, so the shards of an instance that went away are
+// picked up by the survivors.
+type ShardClaimer struct {
+	conn   *amqp.Connection
+	prefix string
+	shards int
+	max    int
+	claim  func(int) (*amqp.Channel, error)
+
+	mu       sync.Mutex
+	claimed  map[int]*amqp.Channel
+	lastFree map[int]bool
+}
+
+// Claimed lists the shards this instance currently consumes.
+func (c *ShardClaimer) Claimed() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	shards := []int{}
+	for i := 0; i < c.shards; i++ {
+		if _, ok := c.claimed[i]; ok {
+			shards = append(shards, i)
+		}
+	}
+	return shards
+}
+
+func ClaimShardsGob[T any](
+	ctx context.Context,
+	conn *amqp.Connection,
+	exchange,
+	prefix string,
+	shards,
+	max int,
+	queueType SimpleQueueType,
+	handler func(T) AckType,
+	opts ...QueueOption,
+) *ShardClaimer {
+	c := &ShardClaimer{
+		conn:     conn,
+		prefix:   prefix,
+		shards:   shards,
+		max:      max,
+		claimed:  map[int]*amqp.Channel{},
+		lastFree: map[int]bool{},
+	}
+	c.claim = func(i int) (*amqp.Channel, error) {
+		return subscribe(
+			conn,
+			exchange,
+			ShardQueue(prefix, i),
+			fmt.Sprintf("%s.%d.*", prefix, i),
+			queueType,
+			handler,
+			opts,
+			consumeOptions{exclusive: true},
+			unmarshalGob[T],
+		)
+	}
+
+	// Declare every shard up front so no log is unroutable while a shard
+	// waits to be claimed
+	for i := 0; i < shards; i++ {
+		ch, _, err := DeclareAndBind(conn, exchange, ShardQueue(prefix, i), fmt.Sprintf("%s.%d.*", prefix, i), queueType, opts...)
+		if err != nil {
+			fmt.Printf("error declaring shard %d: %v\n", i, err)
+			continue
+		}
+		ch.Close()
+	}
+
+	go c.run(ctx)
+	return c
+}
+
+func (c *ShardClaimer) run(ctx context.Context) {
+	ticker := time.NewTicker(shardClaimInterval)
+	defer ticker.Stop()
+
+	for {
+		c.claimFree()
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			c.release()
+			return
+		}
+	}
+}
+
+func (c *ShardClaimer) claimFree() {
+	for i := 0; i < c.shards; i++ {
+		// Shards claimed now would be closed under their handlers on release
+		if shuttingDown() {
+			return
+		}
+		c.mu.Lock()
+		_, held := c.claimed[i]
+		full := len(c.claimed) >= c.max
+		orphaned := c.lastFree[i]
+		c.mu.Unlock()
+		if held {
+			continue
+		}
+
+		free := c.isFree(i)
+		c.mu.Lock()
+		c.lastFree[i] = free
+		c.mu.Unlock()
+		if !free || (full && !orphaned) {
+			continue
+		}
+
+		// Another instance's exclusive consumer makes the broker refuse us
+		ch, err := c.claim(i)
+		if err != nil {
+			continue
+		}
+		fmt.Printf("Claimed shard %d\n", i)
+
+		c.mu.Lock()
+		c.claimed[i] = ch
+		c.lastFree[i] = false
+		c.mu.Unlock()
+		go c.watch(i, ch)
+	}
+}
+
+// isFree reports whether shard i's queue has no consumer. A queue that
+// doesn't exist yet is free too.
+func (c *ShardClaimer) isFree(i int) bool {
+	ch, err := c.conn.Channel()
+	if err != nil {
+		return false
+	}
+	defer ch.Close()
+
+	queue, err := ch.QueueDeclarePassive(ShardQueue(c.prefix, i), false, false, false, false, nil)
+	if err != nil {
+		var amqpErr *amqp.Error
+		return errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound
+	}
+	return queue.Consumers == 0
+}
+
+func (c *ShardClaimer) watch(i int, ch *amqp.Channel) {
+	<-ch.NotifyClose(make(chan *amqp.Error, 1))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.claimed[i] == ch {
+		delete(c.claimed, i)
+		fmt.Printf("Lost shard %d\n", i)
+	}
+}
+
+func (c *ShardClaimer) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, ch := range c.claimed {
+		delete(c.claimed, i)
+		ch.Close()
+	}
+}
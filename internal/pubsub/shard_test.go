@@ -0,0 +1,41 @@
+package pubsub
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardFor(t *testing.T) {
+	for _, shards := range []int{1, 2, 8, 100} {
+		for i := range 1000 {
+			key := fmt.Sprintf("player%d", i)
+			got := ShardFor(key, shards)
+			if got < 0 || got >= shards {
+				t.Fatalf("ShardFor(%q, %d) = %d, out of range", key, shards, got)
+			}
+			if again := ShardFor(key, shards); again != got {
+				t.Fatalf("ShardFor(%q, %d) gave %d, then %d", key, shards, got, again)
+			}
+
+			// Growing by one shard only ever moves keys onto the new shard
+			if grown := ShardFor(key, shards+1); grown != got && grown != shards {
+				t.Errorf("ShardFor(%q) moved from %d to %d going to %d shards", key, got, grown, shards+1)
+			}
+		}
+	}
+}
+
+// Each shard queue is bound to "<prefix>.<i>.*", so a key must only match
+// its own shard's binding
+func TestShardKey(t *testing.T) {
+	const shards = 10
+	for _, name := range []string{"alice", "bob", "carol"} {
+		key := ShardKey("game_logs", shards, name)
+		for i := range shards {
+			bound := TopicMatch(fmt.Sprintf("game_logs.%d.*", i), key)
+			if want := i == ShardFor(name, shards); bound != want {
+				t.Errorf("ShardKey(%q) = %q, bound to shard %d: %v, want %v", name, key, i, bound, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// consumer is a running subscription, tracked so Shutdown can stop it and
+// Consumers can report on it.
+type consumer struct {
+	ch    *amqp.Channel
+	queue string
+	tag   string
+	done  chan struct{}
+}
+
+var consumers = struct {
+	sync.Mutex
+	running map[*consumer]struct{}
+	nextID  int
+	// closing is set once Shutdown starts, so nothing new is consumed
+	// while it drains
+	closing bool
+}{running: map[*consumer]struct{}{}}
+
+func trackConsumer(ch *amqp.Channel, queueName string) *consumer {
+	consumers.Lock()
+	defer consumers.Unlock()
+	consumers.nextID++
+	c := &consumer{
+		ch:    ch,
+		queue: queueName,
+		tag:   fmt.Sprintf("%s-%d", queueName, consumers.nextID),
+		done:  make(chan struct{}),
+	}
+	consumers.running[c] = struct{}{}
+	return c
+}
+
+// finished is called once the consumer's delivery channel is closed and its
+// last handler has returned.
+func (c *consumer) finished() {
+	consumers.Lock()
+	defer consumers.Unlock()
+	delete(consumers.running, c)
+	close(c.done)
+}
+
+func shuttingDown() bool {
+	consumers.Lock()
+	defer consumers.Unlock()
+	return consumers.closing
+}
+
+// Shutdown stops every consumer from taking new deliveries, waits for the
+// handlers already running to finish, then closes the consumers' channels.
+// Unacked deliveries go back to their queues. It returns ctx's error if the
+// handlers don't finish in time.
+func Shutdown(ctx context.Context) error {
+	consumers.Lock()
+	consumers.closing = true
+	list := []*consumer{}
+	for c := range consumers.running {
+		list = append(list, c)
+	}
+	consumers.Unlock()
+
+	for _, c := range list {
+		if err := c.ch.Cancel(c.tag, false); err != nil {
+			fmt.Printf("error cancelling consumer %s: %v\n", c.tag, err)
+		}
+	}
+
+	var err error
+	for _, c := range list {
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for _, c := range list {
+		c.ch.Close()
+	}
+	return err
+}
@@ -0,0 +1,169 @@
+package stomp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var ErrClosed = errors.New("stomp connection closed")
+
+// Conn is a STOMP 1.2 connection. Frames are written under a lock and read
+// by a single goroutine that hands MESSAGE frames to their subscription.
+type Conn struct {
+	nc net.Conn
+
+	wmu sync.Mutex
+
+	mu     sync.Mutex
+	subs   map[string]chan Frame
+	nextID int
+	err    error
+	done   chan struct{}
+}
+
+func Dial(addr, login, passcode string) (*Conn, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to server: %v", err)
+	}
+
+	r := bufio.NewReader(nc)
+	connect := NewFrame("CONNECT", map[string]string{
+		"accept-version": "1.2",
+		"host":           "/",
+		"login":          login,
+		"passcode":       passcode,
+		"heart-beat":     "0,0",
+	}, nil)
+	if err := WriteFrame(nc, connect); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	f, err := ReadFrame(r)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("error reading CONNECTED frame: %v", err)
+	}
+	if f.Command != "CONNECTED" {
+		nc.Close()
+		return nil, fmt.Errorf("stomp connect refused: %s", f.Headers["message"])
+	}
+
+	c := &Conn{
+		nc:   nc,
+		subs: map[string]chan Frame{},
+		done: make(chan struct{}),
+	}
+	go c.readLoop(r)
+	return c, nil
+}
+
+func (c *Conn) readLoop(r *bufio.Reader) {
+	var err error
+	for {
+		var f Frame
+		f, err = ReadFrame(r)
+		if err != nil {
+			break
+		}
+		if f.Command == "ERROR" {
+			err = fmt.Errorf("stomp error: %s %s", f.Headers["message"], f.Body)
+			break
+		}
+		if f.Command != "MESSAGE" {
+			continue
+		}
+
+		c.mu.Lock()
+		sub, ok := c.subs[f.Headers["subscription"]]
+		c.mu.Unlock()
+		if ok {
+			sub <- f
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	for id, sub := range c.subs {
+		close(sub)
+		delete(c.subs, id)
+	}
+	close(c.done)
+}
+
+// Err reports why the connection stopped, once it has.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) write(f Frame) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return WriteFrame(c.nc, f)
+}
+
+func (c *Conn) Send(destination, contentType string, body []byte, headers map[string]string) error {
+	f := NewFrame("SEND", map[string]string{
+		"destination":  destination,
+		"content-type": contentType,
+	}, body)
+	for k, v := range headers {
+		f.Headers[k] = v
+	}
+	return c.write(f)
+}
+
+// Subscribe starts delivering MESSAGE frames for destination on the
+// returned channel until the connection closes.
+func (c *Conn) Subscribe(destination string, headers map[string]string) (<-chan Frame, error) {
+	c.mu.Lock()
+	c.nextID++
+	id := strconv.Itoa(c.nextID)
+	sub := make(chan Frame, 16)
+	c.subs[id] = sub
+	c.mu.Unlock()
+
+	f := NewFrame("SUBSCRIBE", map[string]string{
+		"id":          id,
+		"destination": destination,
+	}, nil)
+	for k, v := range headers {
+		f.Headers[k] = v
+	}
+	if err := c.write(f); err != nil {
+		c.mu.Lock()
+		delete(c.subs, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (c *Conn) Ack(message Frame) error {
+	return c.write(NewFrame("ACK", map[string]string{"id": message.Headers["ack"]}, nil))
+}
+
+func (c *Conn) Nack(message Frame, requeue bool) error {
+	return c.write(NewFrame("NACK", map[string]string{
+		"id":      message.Headers["ack"],
+		"requeue": strconv.FormatBool(requeue),
+	}, nil))
+}
+
+func (c *Conn) Close() error {
+	c.write(NewFrame("DISCONNECT", nil, nil))
+	return c.nc.Close()
+}
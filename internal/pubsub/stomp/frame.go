@@ -0,0 +1,108 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Frame is a single STOMP 1.2 frame.
+type Frame struct {
+	Command string
+	Headers map[string]string
+	Body    []byte
+}
+
+func NewFrame(command string, headers map[string]string, body []byte) Frame {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	return Frame{Command: command, Headers: headers, Body: body}
+}
+
+var headerEscaper = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+var headerUnescaper = strings.NewReplacer(`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":")
+
+// WriteFrame always sets content-length so binary (gob) bodies survive NULs.
+func WriteFrame(w io.Writer, f Frame) error {
+	var buf bytes.Buffer
+	buf.WriteString(f.Command)
+	buf.WriteByte('\n')
+	for k, v := range f.Headers {
+		if k == "content-length" {
+			continue
+		}
+		buf.WriteString(headerEscaper.Replace(k))
+		buf.WriteByte(':')
+		buf.WriteString(headerEscaper.Replace(v))
+		buf.WriteByte('\n')
+	}
+	fmt.Fprintf(&buf, "content-length:%d\n\n", len(f.Body))
+	buf.Write(f.Body)
+	buf.WriteByte(0)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ReadFrame skips heart-beat newlines and reads the next frame.
+func ReadFrame(r *bufio.Reader) (Frame, error) {
+	var command string
+	for command == "" {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return Frame{}, err
+		}
+		command = strings.TrimRight(line, "\r\n")
+	}
+
+	f := NewFrame(command, nil, nil)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return Frame{}, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return Frame{}, fmt.Errorf("malformed stomp header %q", line)
+		}
+		k = headerUnescaper.Replace(k)
+		// Repeated headers: only the first one counts
+		if _, seen := f.Headers[k]; !seen {
+			f.Headers[k] = headerUnescaper.Replace(v)
+		}
+	}
+
+	if length, ok := f.Headers["content-length"]; ok {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 {
+			return Frame{}, fmt.Errorf("invalid content-length %q", length)
+		}
+		f.Body = make([]byte, n)
+		if _, err := io.ReadFull(r, f.Body); err != nil {
+			return Frame{}, err
+		}
+		nul, err := r.ReadByte()
+		if err != nil {
+			return Frame{}, err
+		}
+		if nul != 0 {
+			return Frame{}, errors.New("stomp frame body not terminated by NUL")
+		}
+		return f, nil
+	}
+
+	body, err := r.ReadBytes(0)
+	if err != nil {
+		return Frame{}, err
+	}
+	f.Body = body[:len(body)-1]
+	return f, nil
+}
@@ -0,0 +1,155 @@
+package stomp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+)
+
+// Connect dials the broker's STOMP plugin (see the Dockerfile and rabbit.sh).
+func Connect() (*Conn, error) {
+	return Dial("localhost:61613", "guest", "guest")
+}
+
+// Destination maps an AMQP exchange and routing key to RabbitMQ's STOMP
+// destination for them.
+func Destination(exchange, key string) string {
+	return "/exchange/" + escapeDestination(exchange) + "/" + escapeDestination(key)
+}
+
+// ParseDestination is the inverse of Destination.
+func ParseDestination(destination string) (exchange, key string, err error) {
+	rest, ok := strings.CutPrefix(destination, "/exchange/")
+	if !ok {
+		return "", "", fmt.Errorf("%s is not an exchange destination", destination)
+	}
+	exchange, key, _ = strings.Cut(rest, "/")
+	return unescapeDestination(exchange), unescapeDestination(key), nil
+}
+
+func escapeDestination(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "%", "%25"), "/", "%2F")
+}
+
+func unescapeDestination(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "%2F", "/"), "%25", "%")
+}
+
+func PublishJSON[T any](conn *Conn, exchange, key string, val T) error {
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return conn.Send(Destination(exchange, key), "application/json", bytes, nil)
+}
+
+func PublishGob[T any](conn *Conn, exchange, key string, val T) error {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(val); err != nil {
+		return err
+	}
+	return conn.Send(Destination(exchange, key), "application/gob", buf.Bytes(), nil)
+}
+
+func SubscribeJSON[T any](
+	conn *Conn,
+	exchange,
+	queueName,
+	key string,
+	queueType pubsub.SimpleQueueType,
+	handler func(T) pubsub.AckType,
+) error {
+	return subscribe(conn, exchange, queueName, key, queueType, handler,
+		func(data []byte) (T, error) {
+			var strct T
+			err := json.Unmarshal(data, &strct)
+			return strct, err
+		},
+	)
+}
+
+func SubscribeGob[T any](
+	conn *Conn,
+	exchange,
+	queueName,
+	key string,
+	queueType pubsub.SimpleQueueType,
+	handler func(T) pubsub.AckType,
+) error {
+	return subscribe(conn, exchange, queueName, key, queueType, handler,
+		func(data []byte) (T, error) {
+			buf := bytes.NewBuffer(data)
+			dec := gob.NewDecoder(buf)
+
+			var strct T
+			err := dec.Decode(&strct)
+			return strct, err
+		},
+	)
+}
+
+// subscribe asks RabbitMQ to declare queueName with the same properties and
+// dead-letter exchange pubsub.DeclareAndBind would use, bound to exchange by
+// key.
+func subscribe[T any](
+	conn *Conn,
+	exchange,
+	queueName,
+	key string,
+	queueType pubsub.SimpleQueueType,
+	handler func(T) pubsub.AckType,
+	unmarshaller func([]byte) (T, error),
+) error {
+	transient := queueType == pubsub.Transient
+	headers := map[string]string{
+		"ack":            "client-individual",
+		"prefetch-count": "10",
+		"x-queue-name":   queueName,
+		"durable":        fmt.Sprint(!transient),
+		"auto-delete":    fmt.Sprint(transient),
+		"exclusive":      fmt.Sprint(transient),
+	}
+	switch queueType {
+	case pubsub.Stream:
+		// Streams never dead-letter
+		headers["x-queue-type"] = "stream"
+	case pubsub.Quorum:
+		headers["x-queue-type"] = "quorum"
+		headers["x-dead-letter-exchange"] = "peril_dlx"
+	default:
+		headers["x-dead-letter-exchange"] = "peril_dlx"
+	}
+	messages, err := conn.Subscribe(Destination(exchange, key), headers)
+	if err != nil {
+		return err
+	}
+
+	go consumeFrames(conn, messages, handler, unmarshaller)
+	return nil
+}
+
+func consumeFrames[T any](conn *Conn, ch <-chan Frame, handler func(T) pubsub.AckType, unmarshaller func([]byte) (T, error)) {
+	for message := range ch {
+		data, err := unmarshaller(message.Body)
+		if err != nil {
+			fmt.Printf("error unmarshalling data consumed by client: %v\n", err)
+		}
+
+		switch ackType := handler(data); ackType {
+		case pubsub.Ack:
+			err = conn.Ack(message)
+		case pubsub.NackRequeue:
+			err = conn.Nack(message, true)
+		case pubsub.NackDiscard:
+			err = conn.Nack(message, false)
+		}
+		if err != nil {
+			fmt.Printf("err handling data: %v\n", err)
+		}
+	}
+}
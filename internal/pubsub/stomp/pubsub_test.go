@@ -0,0 +1,272 @@
+package stomp_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/stomp"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/stomp/stomptest"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/routing"
+)
+
+const waitFor = 2 * time.Second
+
+func connect(t *testing.T) (*stomptest.Server, *stomp.Conn) {
+	t.Helper()
+	server, err := stomptest.NewServer()
+	if err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	conn, err := stomp.Dial(server.Addr(), "guest", "guest")
+	if err != nil {
+		server.Close()
+		t.Fatalf("connecting: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+	return server, conn
+}
+
+func TestDestinationRoundTrip(t *testing.T) {
+	tests := []struct {
+		exchange string
+		key      string
+		want     string
+	}{
+		{routing.ExchangePerilTopic, "army_moves.*", "/exchange/peril_topic/army_moves.*"},
+		{routing.ExchangePerilDirect, routing.PauseKey, "/exchange/peril_direct/pause"},
+		{"a/b", "100%", "/exchange/a%2Fb/100%25"},
+	}
+	for _, tc := range tests {
+		got := stomp.Destination(tc.exchange, tc.key)
+		if got != tc.want {
+			t.Errorf("Destination(%q, %q) = %q, want %q", tc.exchange, tc.key, got, tc.want)
+		}
+		exchange, key, err := stomp.ParseDestination(got)
+		if err != nil || exchange != tc.exchange || key != tc.key {
+			t.Errorf("ParseDestination(%q) = %q, %q, %v", got, exchange, key, err)
+		}
+	}
+}
+
+func TestRoundTripJSON(t *testing.T) {
+	_, conn := connect(t)
+
+	got := make(chan routing.PlayingState, 1)
+	err := stomp.SubscribeJSON(conn, routing.ExchangePerilDirect, "pause.test", routing.PauseKey, pubsub.Transient,
+		func(ps routing.PlayingState) pubsub.AckType {
+			got <- ps
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+
+	want := routing.PlayingState{IsPaused: true, Issued: time.Unix(1700000000, 0).UTC()}
+	if err := stomp.PublishJSON(conn, routing.ExchangePerilDirect, routing.PauseKey, want); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+	select {
+	case ps := <-got:
+		if ps.IsPaused != want.IsPaused || !ps.Issued.Equal(want.Issued) {
+			t.Errorf("got %+v, want %+v", ps, want)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("message was never delivered")
+	}
+}
+
+func TestRoundTripGobByPattern(t *testing.T) {
+	_, conn := connect(t)
+
+	got := make(chan routing.GameLog, 1)
+	err := stomp.SubscribeGob(conn, routing.ExchangePerilTopic, "game_logs.test", routing.GameLogSlug+".*.*", pubsub.Durable,
+		func(gl routing.GameLog) pubsub.AckType {
+			got <- gl
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+
+	want := routing.GameLog{Username: "alice", Message: "hello"}
+	if err := stomp.PublishGob(conn, routing.ExchangePerilTopic, routing.GameLogSlug+".0.alice", want); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+	select {
+	case gl := <-got:
+		if gl.Username != want.Username || gl.Message != want.Message {
+			t.Errorf("got %+v, want %+v", gl, want)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("message was never delivered")
+	}
+}
+
+func TestAckTypes(t *testing.T) {
+	tests := []struct {
+		name        string
+		ack         pubsub.AckType
+		deliveries  int
+		deadLetters int
+	}{
+		{"ack settles the message", pubsub.Ack, 1, 0},
+		{"nack requeue redelivers it", pubsub.NackRequeue, 2, 0},
+		{"nack discard dead-letters it", pubsub.NackDiscard, 1, 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server, conn := connect(t)
+
+			// The first delivery gets tc.ack, any redelivery is acked
+			deliveries := make(chan int, 10)
+			n := 0
+			err := stomp.SubscribeJSON(conn, routing.ExchangePerilTopic, "army_moves.test", routing.ArmyMovesPrefix+".*", pubsub.Transient,
+				func(move map[string]any) pubsub.AckType {
+					n++
+					deliveries <- n
+					if n == 1 {
+						return tc.ack
+					}
+					return pubsub.Ack
+				},
+			)
+			if err != nil {
+				t.Fatalf("subscribing: %v", err)
+			}
+			if err := stomp.PublishJSON(conn, routing.ExchangePerilTopic, routing.ArmyMovesPrefix+".alice", map[string]any{"ID": 1}); err != nil {
+				t.Fatalf("publishing: %v", err)
+			}
+
+			for i := 1; i <= tc.deliveries; i++ {
+				select {
+				case <-deliveries:
+				case <-time.After(waitFor):
+					t.Fatalf("got %d deliveries, want %d", i-1, tc.deliveries)
+				}
+			}
+			deadline := time.Now().Add(waitFor)
+			for len(server.DeadLetters()) < tc.deadLetters && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// Nothing more should turn up once the message is settled
+			select {
+			case <-deliveries:
+				t.Errorf("got more than %d deliveries", tc.deliveries)
+			case <-time.After(100 * time.Millisecond):
+			}
+			if got := len(server.DeadLetters()); got != tc.deadLetters {
+				t.Errorf("got %d dead letters, want %d", got, tc.deadLetters)
+			}
+		})
+	}
+}
+
+// RabbitMQ declares the queue from the SUBSCRIBE headers, so they must ask
+// for what pubsub.DeclareAndBind would
+func TestQueueProperties(t *testing.T) {
+	tests := []struct {
+		queueType pubsub.SimpleQueueType
+		want      map[string]string
+	}{
+		{pubsub.Transient, map[string]string{"durable": "false", "exclusive": "true", "x-queue-type": "", "x-dead-letter-exchange": "peril_dlx"}},
+		{pubsub.Durable, map[string]string{"durable": "true", "exclusive": "false", "x-queue-type": "", "x-dead-letter-exchange": "peril_dlx"}},
+		{pubsub.Quorum, map[string]string{"durable": "true", "exclusive": "false", "x-queue-type": "quorum", "x-dead-letter-exchange": "peril_dlx"}},
+		{pubsub.Stream, map[string]string{"durable": "true", "exclusive": "false", "x-queue-type": "stream", "x-dead-letter-exchange": ""}},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.queueType), func(t *testing.T) {
+			server, conn := connect(t)
+			queueName := "queue." + string(tc.queueType)
+			err := stomp.SubscribeJSON(conn, routing.ExchangePerilTopic, queueName, routing.WarRecognitionsPrefix+".#", tc.queueType,
+				func(map[string]any) pubsub.AckType { return pubsub.Ack },
+			)
+			if err != nil {
+				t.Fatalf("subscribing: %v", err)
+			}
+
+			var headers map[string]string
+			for deadline := time.Now().Add(waitFor); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				var ok bool
+				if headers, ok = server.Declared(queueName); ok {
+					break
+				}
+			}
+			if headers == nil {
+				t.Fatal("the queue was never declared")
+			}
+			for name, want := range tc.want {
+				if got := headers[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Like a broker closing a channel, losing the connection puts whatever the
+// handler hadn't settled back on the queue for the next consumer
+func TestUnackedRequeuedOnDisconnect(t *testing.T) {
+	server, first := connect(t)
+	second, err := stomp.Dial(server.Addr(), "guest", "guest")
+	if err != nil {
+		t.Fatalf("connecting again: %v", err)
+	}
+	defer second.Close()
+
+	shard := pubsub.ShardFor("alice", routing.GameLogShards)
+	queueName := pubsub.ShardQueue(routing.GameLogSlug, shard)
+	pattern := fmt.Sprintf("%s.%d.*", routing.GameLogSlug, shard)
+
+	handling := make(chan routing.GameLog, 1)
+	release := make(chan struct{})
+	err = stomp.SubscribeGob(first, routing.ExchangePerilTopic, queueName, pattern, pubsub.Durable,
+		func(gl routing.GameLog) pubsub.AckType {
+			handling <- gl
+			<-release
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatalf("subscribing: %v", err)
+	}
+	defer close(release)
+
+	want := routing.GameLog{Username: "alice", Message: "hello"}
+	key := pubsub.ShardKey(routing.GameLogSlug, routing.GameLogShards, want.Username)
+	if err := stomp.PublishGob(first, routing.ExchangePerilTopic, key, want); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+	select {
+	case <-handling:
+	case <-time.After(waitFor):
+		t.Fatal("message was never delivered")
+	}
+	first.Close()
+
+	got := make(chan routing.GameLog, 1)
+	err = stomp.SubscribeGob(second, routing.ExchangePerilTopic, queueName, pattern, pubsub.Durable,
+		func(gl routing.GameLog) pubsub.AckType {
+			got <- gl
+			return pubsub.Ack
+		},
+	)
+	if err != nil {
+		t.Fatalf("subscribing again: %v", err)
+	}
+	select {
+	case gl := <-got:
+		if gl.Message != want.Message {
+			t.Errorf("got %+v, want %+v", gl, want)
+		}
+	case <-time.After(waitFor):
+		t.Fatal("the unsettled message was never redelivered")
+	}
+}
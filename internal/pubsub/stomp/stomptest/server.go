@@ -0,0 +1,281 @@
+// Package stomptest provides an in-process stand-in for RabbitMQ's STOMP
+// plugin, good enough to exercise the stomp package without a broker.
+package stomptest
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub"
+	"github.com/bootdotdev/learn-pub-sub-starter/internal/pubsub/stomp"
+)
+
+// Server routes SENDs to /exchange/<exchange>/<key> into named queues bound
+// with topic patterns, and redelivers or dead-letters on NACK.
+type Server struct {
+	ln net.Listener
+
+	mu          sync.Mutex
+	queues      map[string]*queue
+	deadLetters []stomp.Frame
+	nextAck     int
+	wg          sync.WaitGroup
+}
+
+type queue struct {
+	exchange string
+	pattern  string
+	// headers of the SUBSCRIBE that declared the queue
+	headers map[string]string
+	ready   []stomp.Frame
+	subs    []*subscription
+	next    int
+}
+
+type subscription struct {
+	client   *client
+	id       string
+	prefetch int
+	unacked  map[string]stomp.Frame
+}
+
+// client frames go through out so dispatch never blocks on a slow reader
+// while holding the server lock, and still arrive in order.
+type client struct {
+	nc  net.Conn
+	out chan stomp.Frame
+}
+
+func newClient(nc net.Conn) *client {
+	c := &client{nc: nc, out: make(chan stomp.Frame, 1024)}
+	go func() {
+		for f := range c.out {
+			if err := stomp.WriteFrame(c.nc, f); err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *client) write(f stomp.Frame) {
+	c.out <- f
+}
+
+// NewServer starts listening on a random local port.
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:     ln,
+		queues: map[string]*queue{},
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Declared returns the headers of the SUBSCRIBE that declared queue name,
+// which RabbitMQ would take its properties from.
+func (s *Server) Declared(name string) (map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		return nil, false
+	}
+	return q.headers, true
+}
+
+// DeadLetters returns the messages NACKed with requeue:false.
+func (s *Server) DeadLetters() []stomp.Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stomp.Frame{}, s.deadLetters...)
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(newClient(nc))
+	}
+}
+
+func (s *Server) serve(c *client) {
+	defer s.disconnect(c)
+	r := bufio.NewReader(c.nc)
+	for {
+		f, err := stomp.ReadFrame(r)
+		if err != nil {
+			return
+		}
+
+		switch f.Command {
+		case "CONNECT", "STOMP":
+			c.write(stomp.NewFrame("CONNECTED", map[string]string{"version": "1.2"}, nil))
+		case "SEND":
+			s.send(f)
+		case "SUBSCRIBE":
+			s.subscribe(c, f)
+		case "ACK":
+			s.settle(c, f.Headers["id"], false, false)
+		case "NACK":
+			s.settle(c, f.Headers["id"], true, f.Headers["requeue"] != "false")
+		case "DISCONNECT":
+			return
+		default:
+			c.write(stomp.NewFrame("ERROR", map[string]string{"message": "unsupported frame " + f.Command}, nil))
+			return
+		}
+	}
+}
+
+func (s *Server) send(f stomp.Frame) {
+	exchange, key, err := stomp.ParseDestination(f.Headers["destination"])
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		if q.exchange == exchange && pubsub.TopicMatch(q.pattern, key) {
+			q.ready = append(q.ready, f)
+			s.dispatch(q)
+		}
+	}
+}
+
+func (s *Server) subscribe(c *client, f stomp.Frame) {
+	exchange, pattern, err := stomp.ParseDestination(f.Headers["destination"])
+	if err != nil {
+		c.write(stomp.NewFrame("ERROR", map[string]string{"message": err.Error()}, nil))
+		return
+	}
+	name := f.Headers["x-queue-name"]
+	if name == "" {
+		name = f.Headers["destination"] + "#" + f.Headers["id"]
+	}
+	prefetch, err := strconv.Atoi(f.Headers["prefetch-count"])
+	if err != nil || prefetch <= 0 {
+		prefetch = 1 << 30
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		q = &queue{exchange: exchange, pattern: pattern, headers: f.Headers}
+		s.queues[name] = q
+	}
+	q.subs = append(q.subs, &subscription{
+		client:   c,
+		id:       f.Headers["id"],
+		prefetch: prefetch,
+		unacked:  map[string]stomp.Frame{},
+	})
+	s.dispatch(q)
+}
+
+// dispatch hands ready messages round-robin to subscriptions with prefetch
+// room. Callers hold s.mu.
+func (s *Server) dispatch(q *queue) {
+	for len(q.ready) > 0 {
+		var sub *subscription
+		for i := 0; i < len(q.subs); i++ {
+			candidate := q.subs[(q.next+i)%len(q.subs)]
+			if len(candidate.unacked) < candidate.prefetch {
+				sub = candidate
+				q.next = (q.next + i + 1) % len(q.subs)
+				break
+			}
+		}
+		if sub == nil {
+			return
+		}
+
+		sent := q.ready[0]
+		q.ready = q.ready[1:]
+		s.nextAck++
+		ackID := strconv.Itoa(s.nextAck)
+
+		msg := stomp.NewFrame("MESSAGE", map[string]string{
+			"subscription": sub.id,
+			"message-id":   ackID,
+			"ack":          ackID,
+		}, sent.Body)
+		for k, v := range sent.Headers {
+			if _, set := msg.Headers[k]; !set {
+				msg.Headers[k] = v
+			}
+		}
+		sub.unacked[ackID] = sent
+		sub.client.write(msg)
+	}
+}
+
+func (s *Server) settle(c *client, ackID string, nack, requeue bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, q := range s.queues {
+		for _, sub := range q.subs {
+			if sub.client != c {
+				continue
+			}
+			sent, ok := sub.unacked[ackID]
+			if !ok {
+				continue
+			}
+			delete(sub.unacked, ackID)
+			if nack && requeue {
+				q.ready = append([]stomp.Frame{sent}, q.ready...)
+			} else if nack {
+				s.deadLetters = append(s.deadLetters, sent)
+			}
+			s.dispatch(q)
+			return
+		}
+	}
+}
+
+// disconnect requeues everything the client hadn't settled, like a broker
+// closing a channel.
+func (s *Server) disconnect(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(c.out)
+	c.nc.Close()
+	for _, q := range s.queues {
+		subs := []*subscription{}
+		for _, sub := range q.subs {
+			if sub.client != c {
+				subs = append(subs, sub)
+				continue
+			}
+			for _, sent := range sub.unacked {
+				q.ready = append(q.ready, sent)
+			}
+		}
+		q.subs = subs
+		q.next = 0
+		s.dispatch(q)
+	}
+}
@@ -0,0 +1,96 @@
+package pubsub
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// StreamOffset tells a stream consumer where to start reading.
+type StreamOffset struct {
+	value any
+}
+
+var (
+	StreamFirst = StreamOffset{"first"}
+	StreamLast  = StreamOffset{"last"}
+	StreamNext  = StreamOffset{"next"}
+)
+
+// StreamAt starts at an absolute offset, e.g. one saved from a previous run.
+func StreamAt(offset int64) StreamOffset {
+	return StreamOffset{offset}
+}
+
+// StreamSince starts at the first chunk of messages stored at or after t.
+func StreamSince(t time.Time) StreamOffset {
+	return StreamOffset{t}
+}
+
+// ParseStreamOffset accepts "first", "last", "next", an integer offset or an
+// RFC 3339 timestamp.
+func ParseStreamOffset(s string) (StreamOffset, error) {
+	switch s {
+	case "first":
+		return StreamFirst, nil
+	case "last":
+		return StreamLast, nil
+	case "next":
+		return StreamNext, nil
+	}
+	if offset, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return StreamAt(offset), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return StreamSince(t), nil
+	}
+	return StreamOffset{}, fmt.Errorf("%s is not a stream offset (first, last, next, a number or an RFC 3339 time)", s)
+}
+
+// WithMaxAge discards stream segments older than age.
+func WithMaxAge(age time.Duration) QueueOption {
+	return func(args amqp.Table) {
+		args["x-max-age"] = fmt.Sprintf("%ds", int64(age.Seconds()))
+	}
+}
+
+func WithMaxLengthBytes(n int64) QueueOption {
+	return func(args amqp.Table) {
+		args["x-max-length-bytes"] = n
+	}
+}
+
+func SubscribeStreamJSON[T any](
+	conn *amqp.Connection,
+	exchange,
+	streamName,
+	key string,
+	offset StreamOffset,
+	handler func(T) AckType,
+	opts ...QueueOption,
+) error {
+	_, err := subscribe(conn, exchange, streamName, key, Stream, handler, opts, consumeOptions{args: offset.consumeArgs()}, unmarshalJSON[T])
+	return err
+}
+
+func SubscribeStreamGob[T any](
+	conn *amqp.Connection,
+	exchange,
+	streamName,
+	key string,
+	offset StreamOffset,
+	handler func(T) AckType,
+	opts ...QueueOption,
+) error {
+	_, err := subscribe(conn, exchange, streamName, key, Stream, handler, opts, consumeOptions{args: offset.consumeArgs()}, unmarshalGob[T])
+	return err
+}
+
+func (o StreamOffset) consumeArgs() amqp.Table {
+	if o.value == nil {
+		return amqp.Table{"x-stream-offset": "next"}
+	}
+	return amqp.Table{"x-stream-offset": o.value}
+}
@@ -4,6 +4,16 @@ import "time"
 
 type PlayingState struct {
 	IsPaused bool
+	// When the pause or resume was issued. A scheduled resume keeps the
+	// time of the command that scheduled it, so any pause or resume issued
+	// since cancels it.
+	Issued time.Time
+}
+
+// Supersedes reports whether ps replaces latest rather than having been
+// issued before it.
+func (ps PlayingState) Supersedes(latest PlayingState) bool {
+	return !ps.Issued.Before(latest.Issued)
 }
 
 type GameLog struct {
@@ -11,3 +21,18 @@ type GameLog struct {
 	Message     string
 	Username    string
 }
+
+type PlayingStateRequest struct {
+	Username string
+}
+
+type PlayerStateRequest struct {
+	Username  string
+	RulesHash string
+	Token     string
+}
+
+type RulesetInfo struct {
+	Version int
+	Hash    string
+}
@@ -1,16 +1,98 @@
 package routing
 
+import "time"
+
 const (
 	ArmyMovesPrefix = "army_moves"
 
+	// The server announces wars as war.<attacker>
 	WarRecognitionsPrefix = "war"
 
 	PauseKey = "pause"
 
+	// Each player gets pauses and army moves on one queue, play.<username>,
+	// so a pause is handled ahead of the moves still waiting there
+	PlayQueuePrefix = "play"
+
+	// The leader announces the ruleset it enforces on this key
+	RulesKey = "rules"
+
 	GameLogSlug = "game_logs"
+
+	// Game logs are routed as game_logs.<shard>.<username> so each player's
+	// logs are consumed in order by whichever server holds the shard
+	GameLogShards = 4
+
+	RPCPrefix = "rpc"
+
+	PlayingStateRPCKey = RPCPrefix + ".playing_state"
+
+	// Commands the leader checks against the canonical game state
+	SpawnRPCKey       = RPCPrefix + ".spawn"
+	MoveRPCKey        = RPCPrefix + ".move"
+	RetreatRPCKey     = RPCPrefix + ".retreat"
+	ReinforceRPCKey   = RPCPrefix + ".reinforce"
+	FortifyRPCKey     = RPCPrefix + ".fortify"
+	PlayerStateRPCKey = RPCPrefix + ".player_state"
+
+	// Authoritative changes to a player's units, routed as state.<username>
+	StateDeltaPrefix = "state"
+
+	// Whichever server holds the exclusive consumer on this queue leads
+	LeaderQueue = "peril_leader"
+)
+
+// Streams keeping every move and war so a match can be replayed
+const (
+	ArmyMovesHistoryStream = "army_moves_history"
+	WarHistoryStream       = "war_history"
+
+	HistoryMaxAge = 7 * 24 * time.Hour
 )
 
 const (
 	ExchangePerilDirect = "peril_direct"
 	ExchangePerilTopic  = "peril_topic"
 )
+
+const (
+	// Army moves are meaningless once other players have moved on
+	ArmyMovesTTL = 5 * time.Second
+
+	// How long players have to retreat, reinforce or fortify after a move
+	// starts a war, before the leader fights it out
+	BattleDelay = 10 * time.Second
+
+	// Oldest logs are dead-lettered once game_logs hits this length
+	GameLogsMaxLength = 10000
+
+	// Redeliveries before a message is dead-lettered as poison
+	GameLogDeliveryLimit = 5
+	WarDeliveryLimit     = 5
+
+	// A player's war queue outlives a dropped connection, but not a player
+	// who never comes back, and keeps only the latest verdicts meanwhile.
+	// Their units are fetched from the server on reconnect either way.
+	WarQueueExpiry    = 30 * time.Minute
+	WarQueueMaxLength = 100
+)
+
+// Priorities let a pause or resume jump ahead of army moves waiting on a
+// player's play queue, which is declared with MaxPriority
+const (
+	MaxPriority = 10
+
+	PlayingStatePriority = 10
+	ArmyMovePriority     = 5
+)
+
+// Game log quotas, in logs per second with a burst allowance. Clients hold
+// themselves to the publish quota and the server drops anything over the
+// consume quota.
+const (
+	GameLogPublishRate  = 5
+	GameLogPublishBurst = 10
+
+	GameLogConsumeRate  = 10
+	GameLogConsumeBurst = 20
+)
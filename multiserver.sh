@@ -8,6 +8,18 @@ fi
 
 num_instances=$1
 
+# Each server takes its share of the game log shards; survivors still pick
+# up a dead instance's shards. PERIL_MAX_LOG_SHARDS overrides the share.
+export PERIL_INSTANCES=$num_instances
+
+# The servers sign and check player tokens with a shared secret. Players
+# need the token for their username: go run ./cmd/server token <username>
+if [ -z "$PERIL_AUTH_SECRET" ]; then
+  PERIL_AUTH_SECRET=$(head -c 32 /dev/urandom | od -An -tx1 | tr -d ' \n')
+  echo "PERIL_AUTH_SECRET is not set; using $PERIL_AUTH_SECRET for this run"
+fi
+export PERIL_AUTH_SECRET
+
 # Array to store process IDs
 declare -a pids
 
@@ -17,6 +29,8 @@ cleanup() {
   for pid in "${pids[@]}"; do
     kill -SIGTERM "$pid"
   done
+  # Let each server drain its in-flight game logs before we exit
+  wait
   exit
 }
 